@@ -1,75 +1,236 @@
 package glob
 
 import (
+	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 )
 
+// Entry is a file matched by a pattern. Args maps the names of the
+// pattern's arguments to the captured strings, numeric arguments ($1)
+// use their number as name.
 type Entry struct {
 	Name string
-	Args map[int]string
+	Args map[string]string
 }
 
 type Pattern struct {
 	re        *regexp.Regexp
-	sourcemap map[int]int
-	glob      string
+	sourcemap map[int]string
+	globs     []string
+	literal   bool
+	wildcards int
+	text      string
 	Pattern   string
 }
 
-var rePattern = regexp.MustCompile(`\$(\d+)`)
+// Any characters except the path separator
+const segment = `[^/]+`
 
 func NewPattern(pattern string) (*Pattern, error) {
 	// Remove ./ from the beginning
 	pattern = path.Clean(pattern)
 
-	// Transform the pattern into
-	// filepath.Glob's one
-	glob := rePattern.ReplaceAllStringFunc(pattern, func(a string) string {
-		return "*"
-	})
-
-	// Compile it into a regexp
-	re, sourcemap, err := toRegexp(pattern)
-	if err != nil {
+	// Compile it into a regexp and filepath.Glob's patterns
+	c := &compiler{
+		sourcemap: make(map[int]string),
+		expr:      "^",
+		globs:     []string{""},
+		literal:   true,
+	}
+	if err := c.compile(pattern); err != nil {
 		return nil, err
 	}
 
 	return &Pattern{
-		re:        re,
-		sourcemap: sourcemap,
-		glob:      glob,
+		re:        c.re,
+		sourcemap: c.sourcemap,
+		globs:     c.globs,
+		literal:   c.literal,
+		wildcards: c.wildcards,
+		text:      c.text,
 		Pattern:   pattern,
 	}, nil
 }
 
-func toRegexp(pattern string) (*regexp.Regexp, map[int]int, error) {
-	count := 0
-	sourcemap := make(map[int]int)
+// A compiler translates a pattern into a regular expression and patterns
+// understood by filepath.Glob, one for each combination of alternatives.
+type compiler struct {
+	re        *regexp.Regexp
+	sourcemap map[int]string
+	count     int
+	expr      string
+	globs     []string
+	literal   bool
+	wildcards int
+	// The unescaped literal characters
+	text string
+}
+
+// Arguments ($n or ${name}) and wildcards (*) match any characters except
+// the path separator. ** matches any number of directories if followed by
+// a slash, otherwise any number of path segments. {a,b} matches one of
+// the comma-separated literal alternatives and [...] one character of a
+// class, negated by a leading ! or ^. A backslash escapes the following
+// character. All other characters are matched literally.
+func (c *compiler) compile(pattern string) error {
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// Recursive wildcards are broader than simple ones
+			c.add(`(?:`+segment+`/)*`, "**/")
+			c.wildcards++
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			c.add(segment+`(?:/`+segment+`)*`, "**")
+			c.wildcards++
+			i += 2
+		case pattern[i] == '*':
+			c.add(segment, "*")
+			i++
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			c.addLiteral(pattern[i+1 : i+2])
+			i += 2
+		case argumentEnd(pattern, i) != -1:
+			end := argumentEnd(pattern, i)
+			c.sourcemap[c.count] = argumentName(pattern[i:end])
+			c.count++
 
-	pattern = rePattern.ReplaceAllStringFunc(pattern, func(match string) string {
-		num, _ := strconv.Atoi(match[1:])
-		sourcemap[count] = num
+			c.add(`(`+segment+`)`, "*")
+			i = end
+		case pattern[i] == '{' && strings.IndexByte(pattern[i:], '}') != -1:
+			end := i + strings.IndexByte(pattern[i:], '}')
+			c.addAlternatives(strings.Split(pattern[i+1:end], ","))
+			i = end + 1
+		case pattern[i] == '[' && strings.IndexByte(pattern[i+1:], ']') > 0:
+			end := i + 1 + strings.IndexByte(pattern[i+1:], ']')
+			c.addClass(pattern[i+1 : end])
+			i = end + 1
+		default:
+			c.addLiteral(pattern[i : i+1])
+			i++
+		}
+	}
 
-		count++
-		return `([A-Za-z0-9\-_\.]+)`
-	})
+	var err error
+	c.re, err = regexp.Compile(c.expr + "$")
+	return err
+}
+
+// Add a wildcard token to the regular expression and the globs.
+func (c *compiler) add(expr, glob string) {
+	c.expr += expr
+	for index := range c.globs {
+		c.globs[index] += glob
+	}
+	c.literal = false
+	c.wildcards++
+}
+
+func (c *compiler) addLiteral(str string) {
+	c.text += str
+	c.expr += regexp.QuoteMeta(str)
+	glob := escapeGlob(str)
+	for index := range c.globs {
+		c.globs[index] += glob
+	}
+}
+
+// Every alternative multiplies the globs since filepath.Glob does not
+// support alternations.
+func (c *compiler) addAlternatives(alternatives []string) {
+	exprs := make([]string, len(alternatives))
+	for index, alternative := range alternatives {
+		exprs[index] = regexp.QuoteMeta(alternative)
+	}
+	c.expr += `(?:` + strings.Join(exprs, "|") + `)`
+
+	globs := make([]string, 0, len(c.globs)*len(alternatives))
+	for _, glob := range c.globs {
+		for _, alternative := range alternatives {
+			globs = append(globs, glob+escapeGlob(alternative))
+		}
+	}
+	c.globs = globs
+	c.literal = false
+	c.wildcards++
+}
+
+// Classes never match the path separator.
+func (c *compiler) addClass(class string) {
+	negated := false
+	if class[0] == '!' || class[0] == '^' {
+		negated = true
+		class = class[1:]
+	}
+
+	if negated {
+		c.add(`[^/`+class+`]`, `[^`+class+`]`)
+	} else {
+		c.add(`[`+class+`]`, `[`+class+`]`)
+	}
+}
+
+// Escape characters with a special meaning for filepath.Glob.
+func escapeGlob(str string) string {
+	escaped := ""
+	for i := 0; i < len(str); i++ {
+		if strings.IndexByte(`*?[\`, str[i]) != -1 {
+			escaped += `\`
+		}
+		escaped += str[i : i+1]
+	}
+	return escaped
+}
+
+// Return the end of the argument, either $n or ${name}, starting at
+// index start of str or -1 if there is none.
+func argumentEnd(str string, start int) int {
+	if str[start] != '$' || start+1 >= len(str) {
+		return -1
+	}
+
+	if isDigit(str[start+1]) {
+		end := start + 1
+		for end < len(str) && isDigit(str[end]) {
+			end++
+		}
+		return end
+	}
+
+	if str[start+1] == '{' {
+		end := start + 2
+		for end < len(str) && isNameChar(str[end]) {
+			end++
+		}
+		if end > start+2 && end < len(str) && str[end] == '}' {
+			return end + 1
+		}
+	}
+
+	return -1
+}
 
-	pattern = strings.Replace(pattern, "*", `[A-Za-z0-9\-_\.]+`, -1)
+// Extract the name from an argument, i.e. n from $n and ${n}.
+func argumentName(arg string) string {
+	return strings.Trim(arg[1:], "{}")
+}
 
-	pattern = "^" + pattern + "$"
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-	re, err := regexp.Compile(pattern)
-	return re, sourcemap, err
+func isNameChar(c byte) bool {
+	return isDigit(c) || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
 
 func (pattern Pattern) Glob() ([]Entry, error) {
 	entries := make([]Entry, 0)
 
-	files, err := filepath.Glob(pattern.glob)
+	files, err := pattern.files()
 	if err != nil {
 		return entries, err
 	}
@@ -86,6 +247,69 @@ func (pattern Pattern) Glob() ([]Entry, error) {
 	return entries, nil
 }
 
+// Find the files which may match the pattern. filepath.Glob does not
+// support **, so in this case all files below the glob's static prefix
+// are returned.
+func (pattern Pattern) files() ([]string, error) {
+	found := make(map[string]bool)
+	files := make([]string, 0)
+	for _, glob := range pattern.globs {
+		var matches []string
+		var err error
+		if strings.Contains(glob, "**") {
+			matches, err = walk(glob)
+		} else {
+			matches, err = filepath.Glob(glob)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range matches {
+			if !found[file] {
+				found[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	if len(pattern.globs) > 1 {
+		sort.Strings(files)
+	}
+	return files, nil
+}
+
+func walk(glob string) ([]string, error) {
+	root := ""
+	parts := strings.Split(glob, "/")
+	for index, part := range parts {
+		if strings.ContainsAny(part, "*?[") {
+			root = strings.Join(parts[:index], "/")
+			break
+		}
+	}
+	if root == "" && strings.HasPrefix(glob, "/") {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+
+	files := make([]string, 0)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == root {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, err
+}
+
 func (pattern Pattern) Match(file string) (Entry, bool) {
 	entry := Entry{}
 	file = path.Clean(file)
@@ -95,7 +319,7 @@ func (pattern Pattern) Match(file string) (Entry, bool) {
 	}
 	matches := pattern.re.FindAllStringSubmatch(file, -1)[0][1:]
 
-	args := make(map[int]string)
+	args := make(map[string]string)
 	for a, b := range pattern.sourcemap {
 		value, ok := args[b]
 
@@ -111,11 +335,33 @@ func (pattern Pattern) Match(file string) (Entry, bool) {
 	return entry, true
 }
 
+// Literal reports whether the pattern contains neither arguments nor
+// wildcards and therefore only matches a single path, which is returned
+// with escapes removed.
+func (pattern Pattern) Literal() (string, bool) {
+	if !pattern.literal {
+		return "", false
+	}
+	return pattern.text, true
+}
+
+// CompareSpecificity returns a negative number if pattern is more
+// specific than other, a positive one if it is broader and zero if both
+// are equally specific. Patterns with fewer wildcards are more specific,
+// between those with the same number the one with more literal
+// characters wins. Literal patterns are therefore the most specific.
+func (pattern Pattern) CompareSpecificity(other Pattern) int {
+	if pattern.wildcards != other.wildcards {
+		return pattern.wildcards - other.wildcards
+	}
+	return len(other.text) - len(pattern.text)
+}
+
 func (pattern Pattern) String() string {
 	return pattern.Pattern
 }
 
-func SimpleMatch(patternStr, str string) (map[int]string, bool, error) {
+func SimpleMatch(patternStr, str string) (map[string]string, bool, error) {
 	pattern, err := NewPattern(patternStr)
 	if err != nil {
 		return nil, false, err
@@ -128,14 +374,42 @@ func SimpleMatch(patternStr, str string) (map[int]string, bool, error) {
 	return nil, false, nil
 }
 
-func Replace(str string, args map[int]string) string {
-	for index, value := range args {
-		str = strings.Replace(str, "$"+strconv.Itoa(index), value, -1)
+// Escape returns str with all characters having a special meaning in
+// patterns escaped, so the resulting pattern only matches str itself.
+func Escape(str string) string {
+	escaped := ""
+	for i := 0; i < len(str); i++ {
+		if strings.IndexByte(`\*?[{$`, str[i]) != -1 {
+			escaped += `\`
+		}
+		escaped += str[i : i+1]
+	}
+	return escaped
+}
+
+// Replace substitutes the arguments, $n or ${name}, in str. Arguments
+// missing in args are left untouched.
+func Replace(str string, args map[string]string) string {
+	result := ""
+	for i := 0; i < len(str); {
+		end := argumentEnd(str, i)
+		if end == -1 {
+			result += str[i : i+1]
+			i++
+			continue
+		}
+
+		if value, ok := args[argumentName(str[i:end])]; ok {
+			result += value
+		} else {
+			result += str[i:end]
+		}
+		i = end
 	}
-	return str
+	return result
 }
 
-func ReplaceSlice(strs []string, args map[int]string) []string {
+func ReplaceSlice(strs []string, args map[string]string) []string {
 	arr := make([]string, len(strs))
 	for index, value := range strs {
 		arr[index] = Replace(value, args)
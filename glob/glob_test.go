@@ -24,7 +24,7 @@ var globTests = []globTest{
 		[]Entry{
 			Entry{
 				Name: "test/bar/bar",
-				Args: make(map[int]string),
+				Args: make(map[string]string),
 			},
 		},
 	},
@@ -34,14 +34,14 @@ var globTests = []globTest{
 		[]Entry{
 			Entry{
 				Name: "test/bar/bar_test",
-				Args: map[int]string{
-					1: "bar",
+				Args: map[string]string{
+					"1": "bar",
 				},
 			},
 			Entry{
 				Name: "test/baz/baz_test",
-				Args: map[int]string{
-					1: "baz",
+				Args: map[string]string{
+					"1": "baz",
 				},
 			},
 		},
@@ -52,30 +52,30 @@ var globTests = []globTest{
 		[]Entry{
 			Entry{
 				Name: "test/bar/bar",
-				Args: map[int]string{
-					1: "bar",
-					2: "bar",
+				Args: map[string]string{
+					"1": "bar",
+					"2": "bar",
 				},
 			},
 			Entry{
 				Name: "test/bar/bar_test",
-				Args: map[int]string{
-					1: "bar_test",
-					2: "bar",
+				Args: map[string]string{
+					"1": "bar_test",
+					"2": "bar",
 				},
 			},
 			Entry{
 				Name: "test/baz/baz",
-				Args: map[int]string{
-					1: "baz",
-					2: "baz",
+				Args: map[string]string{
+					"1": "baz",
+					"2": "baz",
 				},
 			},
 			Entry{
 				Name: "test/baz/baz_test",
-				Args: map[int]string{
-					1: "baz_test",
-					2: "baz",
+				Args: map[string]string{
+					"1": "baz_test",
+					"2": "baz",
 				},
 			},
 		},
@@ -86,18 +86,88 @@ var globTests = []globTest{
 		[]Entry{
 			Entry{
 				Name: "test/bar/bar_test",
-				Args: map[int]string{
-					1: "bar",
+				Args: map[string]string{
+					"1": "bar",
 				},
 			},
 			Entry{
 				Name: "test/baz/baz_test",
-				Args: map[int]string{
-					1: "baz",
+				Args: map[string]string{
+					"1": "baz",
 				},
 			},
 		},
 	},
+	// Recursive wildcard
+	{
+		"./test/**/*_test",
+		[]Entry{
+			Entry{
+				Name: "test/bar/bar_test",
+				Args: make(map[string]string),
+			},
+			Entry{
+				Name: "test/baz/baz_test",
+				Args: make(map[string]string),
+			},
+		},
+	},
+	{
+		"test/$1/**",
+		[]Entry{
+			Entry{
+				Name: "test/bar/bar",
+				Args: map[string]string{
+					"1": "bar",
+				},
+			},
+			Entry{
+				Name: "test/bar/bar_test",
+				Args: map[string]string{
+					"1": "bar",
+				},
+			},
+			Entry{
+				Name: "test/baz/baz",
+				Args: map[string]string{
+					"1": "baz",
+				},
+			},
+			Entry{
+				Name: "test/baz/baz_test",
+				Args: map[string]string{
+					"1": "baz",
+				},
+			},
+		},
+	},
+	// Alternatives and classes
+	{
+		"./test/{baz,bar}/$1_test",
+		[]Entry{
+			Entry{
+				Name: "test/bar/bar_test",
+				Args: map[string]string{
+					"1": "bar",
+				},
+			},
+			Entry{
+				Name: "test/baz/baz_test",
+				Args: map[string]string{
+					"1": "baz",
+				},
+			},
+		},
+	},
+	{
+		"./test/ba[!r]/*_test",
+		[]Entry{
+			Entry{
+				Name: "test/baz/baz_test",
+				Args: make(map[string]string),
+			},
+		},
+	},
 }
 
 var matchTests = []matchTest{
@@ -108,7 +178,7 @@ var matchTests = []matchTest{
 		true,
 		Entry{
 			Name: "test/bar/bar",
-			Args: make(map[int]string),
+			Args: make(map[string]string),
 		},
 	},
 	{
@@ -124,8 +194,8 @@ var matchTests = []matchTest{
 		true,
 		Entry{
 			Name: "test/baz/foo_test",
-			Args: map[int]string{
-				1: "baz",
+			Args: map[string]string{
+				"1": "baz",
 			},
 		},
 	},
@@ -136,9 +206,9 @@ var matchTests = []matchTest{
 		true,
 		Entry{
 			Name: "test/lol/hihi",
-			Args: map[int]string{
-				1: "hihi",
-				2: "lol",
+			Args: map[string]string{
+				"1": "hihi",
+				"2": "lol",
 			},
 		},
 	},
@@ -155,8 +225,8 @@ var matchTests = []matchTest{
 		true,
 		Entry{
 			Name: "test/foo/foo_test",
-			Args: map[int]string{
-				1: "foo",
+			Args: map[string]string{
+				"1": "foo",
 			},
 		},
 	},
@@ -166,6 +236,150 @@ var matchTests = []matchTest{
 		false,
 		Entry{},
 	},
+	// Recursive wildcard
+	{
+		"src/**/$1.less",
+		"src/main.less",
+		true,
+		Entry{
+			Name: "src/main.less",
+			Args: map[string]string{
+				"1": "main",
+			},
+		},
+	},
+	{
+		"src/**/$1.less",
+		"src/includes/mixins/colors.less",
+		true,
+		Entry{
+			Name: "src/includes/mixins/colors.less",
+			Args: map[string]string{
+				"1": "colors",
+			},
+		},
+	},
+	{
+		"src/**/$1.less",
+		"lib/main.less",
+		false,
+		Entry{},
+	},
+	{
+		"src/**",
+		"src/a/b/c",
+		true,
+		Entry{
+			Name: "src/a/b/c",
+			Args: make(map[string]string),
+		},
+	},
+	// Arbitrary characters
+	{
+		"content/$1.md",
+		"content/Über uns.md",
+		true,
+		Entry{
+			Name: "content/Über uns.md",
+			Args: map[string]string{
+				"1": "Über uns",
+			},
+		},
+	},
+	{
+		"img/$1@2x.png",
+		"img/logo+1@2x.png",
+		true,
+		Entry{
+			Name: "img/logo+1@2x.png",
+			Args: map[string]string{
+				"1": "logo+1",
+			},
+		},
+	},
+	{
+		"src/*/$1",
+		"src/a/b/c",
+		false,
+		Entry{},
+	},
+	// Escaped literals
+	{
+		"file+1.txt",
+		"file+1.txt",
+		true,
+		Entry{
+			Name: "file+1.txt",
+			Args: make(map[string]string),
+		},
+	},
+	{
+		"file.txt",
+		"fileXtxt",
+		false,
+		Entry{},
+	},
+	// Alternatives and classes
+	{
+		"src/$1.{jpg,png}",
+		"src/logo.png",
+		true,
+		Entry{
+			Name: "src/logo.png",
+			Args: map[string]string{
+				"1": "logo",
+			},
+		},
+	},
+	{
+		"src/$1.{jpg,png}",
+		"src/logo.gif",
+		false,
+		Entry{},
+	},
+	{
+		"img/[a-z]*.svg",
+		"img/logo.svg",
+		true,
+		Entry{
+			Name: "img/logo.svg",
+			Args: make(map[string]string),
+		},
+	},
+	{
+		"img/[a-z]*.svg",
+		"img/Logo.svg",
+		false,
+		Entry{},
+	},
+	{
+		"img/[!a-z]*.svg",
+		"img/Logo.svg",
+		true,
+		Entry{
+			Name: "img/Logo.svg",
+			Args: make(map[string]string),
+		},
+	},
+	// Named arguments
+	{
+		"src/${lang}/${page}.md",
+		"src/de/index.md",
+		true,
+		Entry{
+			Name: "src/de/index.md",
+			Args: map[string]string{
+				"lang": "de",
+				"page": "index",
+			},
+		},
+	},
+	{
+		"src/${page}/${page}.md",
+		"src/foo/bar.md",
+		false,
+		Entry{},
+	},
 }
 
 func TestGlob(t *testing.T) {
@@ -202,11 +416,75 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestLiteral(t *testing.T) {
+	literals := map[string]bool{
+		"foo/bar.txt":       true,
+		"foo/$1.txt":        false,
+		"foo/*.txt":         false,
+		"foo/**/bar.txt":    false,
+		"foo/{a,b}.txt":     false,
+		"foo/[ab].txt":      false,
+		"foo/bar+1$.txt":    true,
+		"foo/{unclosed.txt": true,
+	}
+
+	for str, literal := range literals {
+		pattern, err := NewPattern(str)
+		if err != nil {
+			t.Errorf("pattern %s failed: %s", str, err)
+			continue
+		}
+		if _, ok := pattern.Literal(); ok != literal {
+			t.Errorf("pattern %s: expected Literal() to be %t", str, literal)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	name := `a[1]{b,c}*$1\.txt`
+	pattern, err := NewPattern(Escape(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text, ok := pattern.Literal(); !ok || text != name {
+		t.Errorf("expected escaped pattern to be literal %s, got %s", name, text)
+	}
+	if _, matches := pattern.Match(name); !matches {
+		t.Errorf("expected escaped pattern to match %s", name)
+	}
+}
+
+func TestCompareSpecificity(t *testing.T) {
+	// Sorted from the most specific to the broadest
+	patterns := []string{
+		"dist/index.html",
+		"dist/in$1.html",
+		"dist/$1.html",
+		"dist/$1/$2.html",
+		"dist/**",
+	}
+
+	for index := 1; index < len(patterns); index++ {
+		a, _ := NewPattern(patterns[index-1])
+		b, _ := NewPattern(patterns[index])
+		if a.CompareSpecificity(*b) >= 0 || b.CompareSpecificity(*a) <= 0 {
+			t.Errorf("expected %s to be more specific than %s", a, b)
+		}
+	}
+
+	a, _ := NewPattern("dist/$1.js")
+	b, _ := NewPattern("dist/*.js")
+	if a.CompareSpecificity(*b) != 0 {
+		t.Errorf("expected %s and %s to be equally specific", a, b)
+	}
+}
+
 func TestReplace(t *testing.T) {
-	out := Replace("foo/$2/$1-hi/lol", map[int]string{
-		1: "bar",
-		2: "baz",
-		3: "boo",
+	out := Replace("foo/$2/$1-hi/lol", map[string]string{
+		"1": "bar",
+		"2": "baz",
+		"3": "boo",
 	})
 
 	if out != "foo/baz/bar-hi/lol" {
@@ -214,14 +492,27 @@ func TestReplace(t *testing.T) {
 	}
 }
 
+func TestReplaceNamed(t *testing.T) {
+	out := Replace("dist/${lang}/${page}.html?$1$10${missing}", map[string]string{
+		"1":    "one",
+		"10":   "ten",
+		"lang": "de",
+		"page": "index",
+	})
+
+	if out != "dist/de/index.html?oneten${missing}" {
+		t.Errorf("unexpected result: %s", out)
+	}
+}
+
 func TestReplaceSlice(t *testing.T) {
 	out := ReplaceSlice([]string{
 		"foo/$2/$1-hi/lol",
 		"$1/$2/$3",
-	}, map[int]string{
-		1: "bar",
-		2: "baz",
-		3: "boo",
+	}, map[string]string{
+		"1": "bar",
+		"2": "baz",
+		"3": "boo",
 	})
 
 	if out[0] != "foo/baz/bar-hi/lol" {
@@ -7,8 +7,15 @@ import (
 type ParseError struct {
 	Line int
 	Desc string
+	// File in which the error occurred, empty if the code has not been
+	// read from a file
+	File string
 }
 
 func (err ParseError) Error() string {
-	return err.Desc + " at line " + strconv.Itoa(err.Line)
+	desc := err.Desc + " at line " + strconv.Itoa(err.Line)
+	if err.File != "" {
+		desc += " in " + err.File
+	}
+	return desc
 }
@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"strings"
+)
+
+// A lexer reads a Poulfile line by line outside of blocks. Block bodies
+// are read as a whole and kept verbatim, so their closing bracket is the
+// one matching the opening bracket instead of any line containing a
+// bracket.
+type lexer struct {
+	code string
+	pos  int
+	// Number of the line starting at pos, counting from zero
+	line int
+}
+
+func newLexer(code string) *lexer {
+	return &lexer{code: code}
+}
+
+// Read the next line without the newline. It returns false at the end
+// of the code.
+func (lex *lexer) nextLine() (string, int, bool) {
+	if lex.pos >= len(lex.code) {
+		return "", lex.line, false
+	}
+
+	start, lineNr := lex.pos, lex.line
+	end := strings.Index(lex.code[start:], Newline)
+	if end == -1 {
+		lex.pos = len(lex.code)
+	} else {
+		end += start
+		lex.pos = end + len(Newline)
+		lex.line++
+	}
+
+	if end == -1 {
+		return lex.code[start:], lineNr, true
+	}
+	return lex.code[start:end], lineNr, true
+}
+
+// Read a block body up to the closing bracket matching the opening one,
+// which must be followed by the end of the line. Brackets inside quotes,
+// escaped by a backslash or in comments are ignored. As these rules
+// follow the shell, a line consisting only of a closing bracket closes
+// the block if and only if it isn't indented deeper than the block's
+// header, given as indent, whatever the nesting or quoting. It returns
+// false if the code ends before the block does.
+func (lex *lexer) body(indent int) (string, bool, error) {
+	start := lex.pos
+	depth := 0
+	var quote byte
+
+	for ; lex.pos < len(lex.code); lex.pos++ {
+		if closing, width := lex.closingLine(start); closing {
+			// An apostrophe, e.g. in a heredoc or in a comment of
+			// another language, must not hide the end of the block
+			quote = 0
+			bracket := lex.pos + width
+			if width <= indent {
+				body := lex.code[start:lex.pos]
+				lex.pos = bracket + 1
+				return body, true, lex.endOfLine()
+			}
+			if depth > 0 {
+				depth--
+			}
+			lex.pos = bracket
+			continue
+		}
+
+		char := lex.code[lex.pos]
+		if char == Newline[0] {
+			lex.line++
+		}
+
+		switch {
+		case quote == '\'':
+			// Nothing is escaped in single quotes
+			if char == '\'' {
+				quote = 0
+			}
+		case char == '\\':
+			// Skip the escaped character
+			if lex.pos+1 < len(lex.code) && lex.code[lex.pos+1] == Newline[0] {
+				lex.line++
+			}
+			lex.pos++
+		case quote == '"':
+			if char == '"' {
+				quote = 0
+			}
+		case char == '\'' || char == '"':
+			quote = char
+		case char == Comment && lex.wordStart(start):
+			// Skip the comment up to the end of the line
+			end := strings.Index(lex.code[lex.pos:], Newline)
+			if end == -1 {
+				lex.pos = len(lex.code)
+			} else {
+				lex.pos += end - 1
+			}
+		case char == BracketOpen:
+			depth++
+		case char == BracketClose[0] && depth > 0:
+			depth--
+		case char == BracketClose[0]:
+			body := trimLastLine(lex.code[start:lex.pos])
+			lex.pos++
+			return body, true, lex.endOfLine()
+		}
+	}
+
+	return "", false, nil
+}
+
+// Read a fenced block body up to the line consisting of the closing
+// fence. Nothing inside is interpreted. It returns false if the code ends
+// before the block does.
+func (lex *lexer) fencedBody() (string, bool) {
+	start := lex.pos
+	for {
+		end := lex.pos
+		line, _, ok := lex.nextLine()
+		if !ok {
+			return "", false
+		}
+
+		if strings.TrimSpace(line) == FenceClose {
+			return lex.code[start:end], true
+		}
+	}
+}
+
+// Check whether pos starts a line consisting only of a closing bracket
+// and return the bracket's indentation.
+func (lex *lexer) closingLine(start int) (bool, int) {
+	if lex.pos != start && lex.code[lex.pos-1] != Newline[0] {
+		return false, 0
+	}
+
+	line := lex.code[lex.pos:]
+	if end := strings.Index(line, Newline); end != -1 {
+		line = line[:end]
+	}
+	return strings.TrimSpace(line) == BracketClose, indentation(line)
+}
+
+// Check whether the character at pos starts a word and may therefore
+// start a comment, unlike e.g. the hash in $# or ${#array}.
+func (lex *lexer) wordStart(start int) bool {
+	if lex.pos == start {
+		return true
+	}
+	return strings.IndexByte(" \t\n;&|(", lex.code[lex.pos-1]) != -1
+}
+
+// Skip the rest of the line after a closing bracket, which may only
+// contain whitespace or a comment.
+func (lex *lexer) endOfLine() error {
+	lineNr := lex.line
+	line, _, _ := lex.nextLine()
+	line = strings.TrimSpace(line)
+	if line != "" && line[0] != Comment {
+		return ParseError{
+			Line: lineNr + 1,
+			Desc: "Expected end of line after block",
+		}
+	}
+	return nil
+}
+
+// Return the length of the line's leading whitespace.
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// Remove the indentation of the closing bracket from the end of a body.
+func trimLastLine(body string) string {
+	index := strings.LastIndex(body, Newline) + 1
+	if strings.TrimSpace(body[index:]) == "" {
+		return body[:index]
+	}
+	return body
+}
@@ -1,44 +1,98 @@
 package parser
 
 import (
+	"github.com/Acconut/poul/glob"
 	prog "github.com/Acconut/poul/program"
-	"io"
+	"io/ioutil"
+	"path"
 	"regexp"
 	"strings"
 )
 
 const (
-	Newline            = "\n"
-	Comment      uint8 = '#'
-	Arrow              = "->"
-	Comma              = ","
-	Slash              = "/"
-	BracketOpen  uint8 = '{'
-	BracketClose       = "}"
+	Newline              = "\n"
+	Comment        uint8 = '#'
+	Arrow                = prog.Arrow
+	AggregateArrow       = prog.AggregateArrow
+	Phony                = prog.Phony
+	Comma                = ","
+	Slash                = "/"
+	BracketOpen    uint8 = '{'
+	BracketClose         = "}"
+	FenceOpen            = "{{"
+	FenceClose           = "}}"
 )
 
 var (
 	ReTemplateStart = regexp.MustCompile(`^([A-Za-z0-9_\-]+)\s*(\([^\)]+\))?$`)
-	ReStepName      = regexp.MustCompile(`^([^\(]+)(\(([^\)]+)\))?\s*->\s(.+)$`)
+	ReInclude       = regexp.MustCompile(`^include\s+([^=\s{]|[^=\s].*[^{\s])$`)
+	ReVariable      = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=(?:\s*([^>\s](?:.*[^{\s])?))?$`)
+	ReReference     = regexp.MustCompile(`\$\(([^\)]*)\)`)
+	RePhonyName     = regexp.MustCompile(`^phony\s+([^\s\(]+)\s*(\(([^\)]+)\))?$`)
+	ReShell         = regexp.MustCompile(`^(.*?)\s+@shell\s+(.+)$`)
+	ReStepName      = regexp.MustCompile(`^([^\(]+)(\(([^\)]+)\))?\s*(->|=>)\s(.+)$`)
 )
 
 func Parse(code string) (*prog.Program, error) {
+	return ParseWithVariables(code, nil)
+}
+
+// ParseWithVariables parses code like Parse but the given variables
+// override the ones defined in the code, e.g. OUT = dist.
+func ParseWithVariables(code string, overrides map[string]string) (*prog.Program, error) {
+	return parse(code, "", nil, overrides, nil)
+}
+
+// ParseFile reads and parses the Poulfile called name. Included files are
+// resolved relative to the directory of the including one.
+func ParseFile(name string, overrides map[string]string) (*prog.Program, error) {
+	return parseFile(path.Clean(name), nil, overrides, nil)
+}
+
+// Parse the file called name, which is included by the files in parents.
+// It starts with the variables defined so far.
+func parseFile(name string, variables, overrides map[string]string, parents []string) (*prog.Program, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(string(b), name, variables, overrides, append(parents, name))
+}
+
+func parse(code, file string, variables, overrides map[string]string, parents []string) (*prog.Program, error) {
+	program, err := parseCode(code, file, variables, overrides, parents)
+	if perr, ok := err.(ParseError); ok && perr.File == "" {
+		// Errors in included files already name their file
+		perr.File = file
+		err = perr
+	}
+	return program, err
+}
 
-	// Split code into lines
-	lines := strings.Split(code, Newline)
+func parseCode(code, file string, variables, overrides map[string]string, parents []string) (*prog.Program, error) {
+	lex := newLexer(code)
 
 	program := prog.Program{
 		Steps:     make([]prog.Step, 0),
 		Templates: make(map[string]prog.Template),
 	}
 
-	inBlock := false
-	name := ""
-	body := ""
-	blockStart := 0
+	for name, value := range variables {
+		setVariable(&program, name, value)
+	}
+	for name, value := range overrides {
+		setVariable(&program, name, value)
+	}
+
+	for {
+		line, lineNumber, ok := lex.nextLine()
+		if !ok {
+			break
+		}
 
-	for lineNumber, line := range lines {
-		// Trim line
+		// Trim line, remembering the indentation of block headers
+		indent := indentation(line)
 		line = strings.TrimSpace(line)
 
 		// Ignore empty lines
@@ -52,69 +106,304 @@ func Parse(code string) (*prog.Program, error) {
 			continue
 		}
 
-		if !inBlock {
-			// We currently aren't in a block and expect
-			// a block beginning (line ending with opening bracket).
-			if line[len(line)-1] != BracketOpen {
-				return nil, ParseError{
-					lineNumber + 1,
-					"Expected block declaration",
-				}
+		// Include other Poulfiles, e.g. include lib/Poulfile
+		if result := ReInclude.FindStringSubmatch(line); result != nil {
+			name, err := interpolate(program.Variables, result[1], lineNumber)
+			if err != nil {
+				return nil, err
 			}
 
-			// Store trimed line without brackets as block name
-			name = strings.TrimSpace(line[:len(line)-1])
+			err = include(&program, file, name, overrides, parents, lineNumber)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Variable definitions, e.g. OUT = dist, may reference
+		// previously defined variables. Aggregate steps with a plain
+		// source, e.g. Gemfile => Gemfile.lock {, aren't definitions.
+		if result := ReVariable.FindStringSubmatch(line); result != nil {
+			if _, ok := overrides[result[1]]; ok {
+				continue
+			}
 
-			// Store line in which the block start
-			blockStart = lineNumber
-			inBlock = true
+			value, err := interpolate(program.Variables, result[2], lineNumber)
+			if err != nil {
+				return nil, err
+			}
+			setVariable(&program, result[1], value)
 			continue
+		}
+
+		// We currently aren't in a block and expect
+		// a block beginning (line ending with opening bracket).
+		if line[len(line)-1] != BracketOpen {
+			return nil, ParseError{
+				Line: lineNumber + 1,
+				Desc: "Expected block declaration",
+			}
+		}
+
+		// The body of a block opened by a fence, e.g. {{, is not
+		// interpreted and ends at the closing fence
+		var body string
+		var err error
+		if strings.HasSuffix(line, FenceOpen) {
+			line = line[:len(line)-len(FenceOpen)]
+			body, ok = lex.fencedBody()
 		} else {
-			// When the line is a closing brackets
-			// we have a block end
-			if line == BracketClose {
-				err := parseBlock(&program, name, body, blockStart)
-				if err != nil {
-					return nil, err
-				}
-
-				// Reset name, body and position
-				inBlock = false
-				name = ""
-				body = ""
-				continue
+			line = line[:len(line)-1]
+			body, ok, err = lex.body(indent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !ok {
+			return nil, ParseError{
+				Line: lineNumber + 1,
+				Desc: "Expected end of block",
 			}
+		}
 
-			// The current line is part of the body
-			body += line + Newline
+		// Use trimed line without brackets as block name
+		name, err := interpolate(program.Variables, strings.TrimSpace(line), lineNumber)
+		if err != nil {
+			return nil, err
 		}
 
+		err = parseBlock(&program, name, body, lineNumber)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if inBlock {
-		return nil, io.EOF
+	return &program, nil
+}
+
+// Parse the file called name, relative to the directory of from, and
+// merge its steps, templates and variables into program.
+func include(program *prog.Program, from, name string, overrides map[string]string, parents []string, lineNr int) error {
+	file := name
+	if !path.IsAbs(name) {
+		file = path.Join(path.Dir(from), name)
 	}
 
-	return &program, nil
+	for _, parent := range parents {
+		if parent == file {
+			return ParseError{
+				Line: lineNr + 1,
+				Desc: "Recursive include of '" + name + "'",
+			}
+		}
+	}
+
+	included, err := parseFile(file, program.Variables, overrides, parents)
+	if err != nil {
+		if _, ok := err.(ParseError); ok {
+			return err
+		}
+		return ParseError{
+			Line: lineNr + 1,
+			Desc: "Unable to read included file '" + name + "'",
+		}
+	}
+
+	relocate(included, path.Dir(name))
+
+	program.Steps = append(program.Steps, included.Steps...)
+	for name, template := range included.Templates {
+		program.Templates[name] = template
+	}
+	for name, value := range included.Variables {
+		setVariable(program, name, value)
+	}
+
+	return nil
+}
+
+// Make the paths used in an included program, which are relative to its
+// directory dir, relative to the including one. Phony steps are
+// referenced by their names, which are kept.
+func relocate(program *prog.Program, dir string) {
+	if dir == "." {
+		return
+	}
+
+	phony := make(map[string]bool)
+	for index, step := range program.Steps {
+		if step.Source != "" {
+			step.Source = relocatePattern(dir, step.Source)
+		}
+		step.Excludes = relocatePatterns(dir, step.Excludes)
+		step.Dependencies = relocatePatterns(dir, step.Dependencies)
+		if step.Phony {
+			phony[step.Destination] = true
+		} else {
+			step.Destination = relocatePattern(dir, step.Destination)
+			step.Outputs = relocatePatterns(dir, step.Outputs)
+		}
+		program.Steps[index] = step
+	}
+
+	for name, template := range program.Templates {
+		destinations := make([]string, len(template.Destinations))
+		for index, dest := range template.Destinations {
+			if pattern, source, ok := prog.SplitFor(dest); ok {
+				dest = relocatePattern(dir, pattern) + " " + prog.For + " " + relocatePattern(dir, source)
+			} else if dest != "" && !phony[dest] {
+				dest = relocatePattern(dir, dest)
+			}
+			destinations[index] = dest
+		}
+		template.Destinations = destinations
+		program.Templates[name] = template
+	}
+}
+
+func relocatePatterns(dir string, patterns []string) []string {
+	if patterns == nil {
+		return nil
+	}
+
+	relocated := make([]string, len(patterns))
+	for index, pattern := range patterns {
+		relocated[index] = relocatePattern(dir, pattern)
+	}
+	return relocated
+}
+
+// Prefix a relative pattern with dir, keeping a leading exclusion mark.
+func relocatePattern(dir, pattern string) string {
+	if strings.HasPrefix(pattern, prog.Exclusion) {
+		return prog.Exclusion + relocatePattern(dir, pattern[len(prog.Exclusion):])
+	}
+	if path.IsAbs(pattern) {
+		return pattern
+	}
+	return path.Join(glob.Escape(dir), pattern)
+}
+
+func setVariable(program *prog.Program, name, value string) {
+	if program.Variables == nil {
+		program.Variables = make(map[string]string)
+	}
+	program.Variables[name] = value
+}
+
+// Replace references to variables, e.g. $(OUT), by their values.
+func interpolate(variables map[string]string, str string, lineNr int) (string, error) {
+	var err error
+	str = ReReference.ReplaceAllStringFunc(str, func(reference string) string {
+		name := ReReference.FindStringSubmatch(reference)[1]
+		value, ok := variables[name]
+		if !ok && err == nil {
+			err = ParseError{
+				Line: lineNr + 1,
+				Desc: "Undefined variable '" + name + "'",
+			}
+		}
+		return value
+	})
+	return str, err
 }
 
 func parseHooks(hooks string) ([]string, []string) {
 	return split(hooks, Slash, Comma)
 }
 
-func parseSources(line string) (string, string, []string) {
+// Parse a step declaration, e.g.
+// src/$1.js, !src/*.test.js (package.json) -> dist/$1.js
+func parseStep(line, code string, lineNr int) (prog.Step, error) {
 	result := ReStepName.FindStringSubmatch(line)
+	if result == nil {
+		return prog.Step{}, ParseError{
+			Line: lineNr + 1,
+			Desc: "Expected step declaration",
+		}
+	}
+
+	// The source position may contain exclusions besides the source
+	step := prog.Step{
+		Code:      code,
+		Aggregate: result[4] == AggregateArrow,
+	}
+	for _, item := range splitPatterns(result[1], Comma) {
+		if strings.HasPrefix(item, prog.Exclusion) {
+			step.Excludes = append(step.Excludes, item[len(prog.Exclusion):])
+			continue
+		}
+		if step.Source != "" || item == "" {
+			return prog.Step{}, ParseError{
+				Line: lineNr + 1,
+				Desc: "Expected exactly one source",
+			}
+		}
+		step.Source = item
+	}
+	if step.Source == "" {
+		return prog.Step{}, ParseError{
+			Line: lineNr + 1,
+			Desc: "Expected exactly one source",
+		}
+	}
+
+	// A step may build multiple destinations at once
+	dests := splitPatterns(result[5], Comma)
+	for _, dest := range dests {
+		if dest == "" {
+			return prog.Step{}, ParseError{
+				Line: lineNr + 1,
+				Desc: "Expected no empty destination",
+			}
+		}
+	}
+	step.Destination = dests[0]
+	if len(dests) > 1 {
+		step.Outputs = dests[1:]
+	}
 
-	source := strings.TrimSpace(result[1])
-	deps := splitSingle(result[3], ",")
-	dest := strings.TrimSpace(result[4])
+	// Don't return an array containing an empty string
+	deps := splitPatterns(result[3], Comma)
+	if len(deps) > 1 || deps[0] != "" {
+		step.Dependencies = deps
+	}
+
+	return step, nil
+}
+
+// Parse a phony step declaration, e.g.
+// phony deploy (dist/app.js)
+// phony src/$1.txt -> announce-$1
+func parsePhony(line, code string, lineNr int) (prog.Step, error) {
+	rest := strings.TrimSpace(line[len(Phony):])
+	if strings.Contains(rest, Arrow) || strings.Contains(rest, AggregateArrow) {
+		step, err := parseStep(rest, code, lineNr)
+		step.Phony = true
+		return step, err
+	}
+
+	result := RePhonyName.FindStringSubmatch(line)
+	if result == nil {
+		return prog.Step{}, ParseError{
+			Line: lineNr + 1,
+			Desc: "Expected phony step declaration",
+		}
+	}
+
+	step := prog.Step{
+		Destination: result[1],
+		Code:        code,
+		Phony:       true,
+	}
 
 	// Don't return an array containing an empty string
-	if len(deps) == 1 && deps[0] == "" {
-		deps = nil
+	deps := splitPatterns(result[3], Comma)
+	if len(deps) > 1 || deps[0] != "" {
+		step.Dependencies = deps
 	}
 
-	return source, dest, deps
+	return step, nil
 }
 
 func splitSingle(line, sep string) []string {
@@ -127,6 +416,27 @@ func splitSingle(line, sep string) []string {
 	return parts
 }
 
+// Split a list of patterns, ignoring separators inside braces which
+// are used for alternatives, e.g. src/*.{js,json}.
+func splitPatterns(line, sep string) []string {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for index := 0; index < len(line); index++ {
+		switch {
+		case line[index] == BracketOpen:
+			depth++
+		case line[index] == BracketClose[0] && depth > 0:
+			depth--
+		case depth == 0 && strings.HasPrefix(line[index:], sep):
+			parts = append(parts, strings.TrimSpace(line[start:index]))
+			start = index + len(sep)
+		}
+	}
+
+	return append(parts, strings.TrimSpace(line[start:]))
+}
+
 func split(line, firstSep, secondSep string) ([]string, []string) {
 	parts := strings.Split(line, firstSep)
 
@@ -137,22 +447,47 @@ func split(line, firstSep, secondSep string) ([]string, []string) {
 }
 
 func parseBlock(program *prog.Program, name, body string, lineNr int) error {
-	if strings.Contains(name, Arrow) {
-		// We found a step declaration (a line containing the arrow ->)
-		source, dest, deps := parseSources(name)
+	// Steps may choose their interpreter, e.g. @shell bash, after the
+	// declaration
+	shell := ""
+	if result := ReShell.FindStringSubmatch(name); result != nil {
+		name, shell = result[1], result[2]
+	}
+
+	if strings.HasPrefix(name, Phony+" ") {
+		// We found a phony step declaration, either a name or a step
+		// declaration following the keyword
+		step, err := parsePhony(name, body, lineNr)
+		if err != nil {
+			return err
+		}
+
+		step.Shell = shell
+		program.Steps = append(program.Steps, step)
+
+		return nil
+	}
 
-		step := prog.Step{
-			Source:       source,
-			Destination:  dest,
-			Code:         body,
-			Dependencies: deps,
+	if strings.Contains(name, Arrow) || strings.Contains(name, AggregateArrow) {
+		// We found a step declaration (a line containing the arrow -> or =>)
+		step, err := parseStep(name, body, lineNr)
+		if err != nil {
+			return err
 		}
 
+		step.Shell = shell
 		program.Steps = append(program.Steps, step)
 
 		return nil
 	}
 
+	if shell != "" {
+		return ParseError{
+			Line: lineNr + 1,
+			Desc: "Unexpected " + prog.ShellAttribute + " attribute",
+		}
+	}
+
 	if ReTemplateStart.Match([]byte(name)) {
 		// We found a template start
 		result := ReTemplateStart.FindStringSubmatch(name)
@@ -171,7 +506,20 @@ func parseBlock(program *prog.Program, name, body string, lineNr int) error {
 			template.Posthooks = postHooks
 		}
 
-		template.Destinations = strings.Split(strings.TrimSpace(body), Newline)
+		// Destinations are listed line by line
+		lines := make([]string, 0)
+		for _, line := range strings.Split(body, Newline) {
+			line = strings.TrimSpace(line)
+			if len(line) > 0 && line[0] != Comment {
+				lines = append(lines, line)
+			}
+		}
+
+		destinations, err := interpolate(program.Variables, strings.Join(lines, Newline), lineNr)
+		if err != nil {
+			return err
+		}
+		template.Destinations = strings.Split(destinations, Newline)
 
 		program.Templates[template.Name] = template
 
@@ -179,7 +527,7 @@ func parseBlock(program *prog.Program, name, body string, lineNr int) error {
 	}
 
 	return ParseError{
-		lineNr + 1,
-		"Unknown block start",
+		Line: lineNr + 1,
+		Desc: "Unknown block start",
 	}
 }
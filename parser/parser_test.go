@@ -2,7 +2,9 @@ package parser
 
 import (
 	p "github.com/Acconut/poul/program"
-	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -78,7 +80,7 @@ command2
 					"here.file",
 					"lol/hoo",
 				},
-				Code: `echo hello
+				Code: `	echo hello
 `,
 			},
 		},
@@ -94,8 +96,8 @@ func TestParserEOF(t *testing.T) {
 	program, err := Parse(`
 foo -> bar {
 `)
-	if err != io.EOF {
-		t.Error("expected io.EOF")
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2, got %v", err)
 	}
 	if program != nil {
 		t.Error("expected nil as return value")
@@ -114,3 +116,495 @@ foo
 		t.Error("expected error at line 2 not at %d", perr.Line)
 	}
 }
+
+func TestParserExcludes(t *testing.T) {
+	program, err := Parse(`
+src/$1.js, !src/*.test.js (src/lib/*.js, !src/lib/*.test.js) -> dist/$1.js {
+	browserify $POUL_SRC > $POUL_DEST
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := p.Step{
+		Source:      "src/$1.js",
+		Excludes:    []string{"src/*.test.js"},
+		Destination: "dist/$1.js",
+		Dependencies: []string{
+			"src/lib/*.js",
+			"!src/lib/*.test.js",
+		},
+		Code: `	browserify $POUL_SRC > $POUL_DEST
+`,
+	}
+	if !reflect.DeepEqual(program.Steps[0], expected) {
+		t.Errorf("expected\n%v\ngot\n%v", expected, program.Steps[0])
+	}
+
+	_, err = Parse(`
+!src/*.test.js -> dist/bundle.js {
+}
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2, got %v", err)
+	}
+}
+
+func TestParserAlternatives(t *testing.T) {
+	program, err := Parse(`
+src/$1.{js,jsx}, !src/*.test.{js,jsx} (src/lib/*.{js,json}, package.json) -> dist/$1.js {
+	browserify $POUL_SRC > $POUL_DEST
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := program.Steps[0]
+	if step.Source != "src/$1.{js,jsx}" || !reflect.DeepEqual(step.Excludes, []string{"src/*.test.{js,jsx}"}) {
+		t.Errorf("unexpected sources: %s, %v", step.Source, step.Excludes)
+	}
+	if !reflect.DeepEqual(step.Dependencies, []string{"src/lib/*.{js,json}", "package.json"}) {
+		t.Errorf("unexpected dependencies: %v", step.Dependencies)
+	}
+}
+
+func TestParserOutputs(t *testing.T) {
+	program, err := Parse(`
+src/$1.ts -> dist/$1.js, dist/$1.js.map {
+	tsc --sourceMap $POUL_SRC
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := program.Steps[0]
+	if step.Destination != "dist/$1.js" || !reflect.DeepEqual(step.Outputs, []string{"dist/$1.js.map"}) {
+		t.Errorf("unexpected destinations: %s, %v", step.Destination, step.Outputs)
+	}
+	if step.String() != "src/$1.ts -> dist/$1.js, dist/$1.js.map" {
+		t.Errorf("unexpected header: %s", step)
+	}
+}
+
+func TestParserAggregate(t *testing.T) {
+	program, err := Parse(`
+src/*.less (src/includes/*.less) => dist/style.css {
+	lessc src/main.less > $POUL_DEST
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := program.Steps[0]
+	if !step.Aggregate || step.Source != "src/*.less" || step.Destination != "dist/style.css" {
+		t.Errorf("unexpected step: %#v", step)
+	}
+	if step.String() != "src/*.less (src/includes/*.less) => dist/style.css" {
+		t.Errorf("unexpected header: %s", step)
+	}
+}
+
+func TestParserAggregateIdentifier(t *testing.T) {
+	program, err := Parse(`
+Gemfile => Gemfile.lock {
+	bundle install
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(program.Variables) != 0 {
+		t.Errorf("unexpected variables: %v", program.Variables)
+	}
+	if len(program.Steps) != 1 {
+		t.Fatalf("expected 1 step, got %d", len(program.Steps))
+	}
+	step := program.Steps[0]
+	if !step.Aggregate || step.Source != "Gemfile" || step.Destination != "Gemfile.lock" {
+		t.Errorf("unexpected step: %#v", step)
+	}
+}
+
+func TestParserPhony(t *testing.T) {
+	program, err := Parse(`
+phony printenv {
+	printenv
+}
+
+phony deploy (dist/app.js, dist/style.css) {
+	rsync -a dist/ server:/srv/
+}
+
+phony src/$1.txt -> announce-$1 {
+	echo "Compiling ${POUL_SRC}"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"phony printenv",
+		"phony deploy (dist/app.js, dist/style.css)",
+		"phony src/$1.txt -> announce-$1",
+	}
+	if len(program.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(program.Steps))
+	}
+	for index, header := range expected {
+		step := program.Steps[index]
+		if !step.Phony || step.String() != header {
+			t.Errorf("expected phony step %s, got %s", header, step)
+		}
+	}
+
+	_, err = Parse(`
+phony two names {
+}
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2, got %v", err)
+	}
+}
+
+func TestParserVariables(t *testing.T) {
+	code := `
+OUT = dist
+JS = $(OUT)/js
+MINIFY = --minify
+
+src/$1.js (package.json) -> $(JS)/$1.js {
+	browserify $MINIFY $POUL_SRC > $POUL_DEST
+}
+
+frontend {
+	$(JS)/app.js
+}
+`
+	program, err := Parse(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"OUT":    "dist",
+		"JS":     "dist/js",
+		"MINIFY": "--minify",
+	}
+	if !reflect.DeepEqual(program.Variables, expected) {
+		t.Errorf("expected variables %v, got %v", expected, program.Variables)
+	}
+	if dest := program.Steps[0].Destination; dest != "dist/js/$1.js" {
+		t.Errorf("unexpected destination: %s", dest)
+	}
+	if code := program.Steps[0].Code; code != "\tbrowserify $MINIFY $POUL_SRC > $POUL_DEST\n" {
+		t.Errorf("expected code not to be interpolated: %s", code)
+	}
+	if dests := program.Templates["frontend"].Destinations; !reflect.DeepEqual(dests, []string{"dist/js/app.js"}) {
+		t.Errorf("unexpected template destinations: %v", dests)
+	}
+
+	// Overrides replace definitions and are used by later ones
+	program, err = ParseWithVariables(code, map[string]string{"OUT": "build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest := program.Steps[0].Destination; dest != "build/js/$1.js" {
+		t.Errorf("unexpected destination: %s", dest)
+	}
+
+	_, err = Parse(`
+src/$1.js -> $(OUT)/$1.js {
+}
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2, got %v", err)
+	}
+}
+
+func TestParseFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, code string) {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("Poulfile", `
+OUT = dist
+include packages/app/Poulfile
+`)
+	write("packages/app/Poulfile", `
+src/$1.js, !src/*.test.js (package.json) -> $(OUT)/$1.js {
+	browserify $POUL_SRC > $POUL_DEST
+}
+
+phony deploy ($(OUT)/app.js) {
+	rsync -a $OUT server:/srv/
+}
+
+app {
+	$(OUT)/app.js
+	deploy
+	$(OUT)/$1.css for src/$1.less
+}
+`)
+
+	program, err := ParseFile(filepath.Join(dir, "Poulfile"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"packages/app/src/$1.js, !packages/app/src/*.test.js (packages/app/package.json) -> packages/app/dist/$1.js",
+		"phony deploy (packages/app/dist/app.js)",
+	}
+	if len(program.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(program.Steps))
+	}
+	for index, header := range expected {
+		if header != program.Steps[index].String() {
+			t.Errorf("expected step %s, got %s", header, program.Steps[index])
+		}
+	}
+
+	dests := program.Templates["app"].Destinations
+	expectedDests := []string{
+		"packages/app/dist/app.js",
+		"deploy",
+		"packages/app/dist/$1.css for packages/app/src/$1.less",
+	}
+	if !reflect.DeepEqual(dests, expectedDests) {
+		t.Errorf("unexpected template destinations: %v", dests)
+	}
+
+	// Errors name the included file
+	write("packages/app/Poulfile", `
+foo
+`)
+	_, err = ParseFile(filepath.Join(dir, "Poulfile"), nil)
+	perr, ok := err.(ParseError)
+	if !ok || perr.Line != 2 || perr.File != filepath.Join(dir, "packages/app/Poulfile") {
+		t.Errorf("expected ParseError in included file, got %v", err)
+	}
+
+	write("packages/app/Poulfile", `
+include ../../Poulfile
+`)
+	_, err = ParseFile(filepath.Join(dir, "Poulfile"), nil)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 || perr.File != filepath.Join(dir, "packages/app/Poulfile") {
+		t.Errorf("expected ParseError for recursive include, got %v", err)
+	}
+
+	write("Poulfile", `
+include missing/Poulfile
+`)
+	_, err = ParseFile(filepath.Join(dir, "Poulfile"), nil)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 || perr.File != filepath.Join(dir, "Poulfile") {
+		t.Errorf("expected ParseError for missing include, got %v", err)
+	}
+
+	// A template may be named include
+	program, err = Parse(`
+include {
+	dist/app.js
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dests := program.Templates["include"].Destinations; !reflect.DeepEqual(dests, []string{"dist/app.js"}) {
+		t.Errorf("unexpected template destinations: %v", dests)
+	}
+
+	// And a variable as well
+	program, err = Parse(`
+include = lib/Poulfile
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := program.Variables["include"]; value != "lib/Poulfile" {
+		t.Errorf("unexpected variables: %v", program.Variables)
+	}
+}
+
+func TestParserBodies(t *testing.T) {
+	program, err := Parse(`
+src/$1.sh -> dist/$1 {
+	build() {
+		if [ -n "$1" ]; then { echo "}"; }; fi
+	}
+	# a comment with a } bracket
+	echo '{' \} ${#POUL_SRC}
+	build "$POUL_SRC"
+}
+
+src/$1.py -> dist/$1.txt {{
+	python3 - <<'EOF'
+if True:
+    print("don't {")
+EOF
+}}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"\tbuild() {\n" +
+			"\t\tif [ -n \"$1\" ]; then { echo \"}\"; }; fi\n" +
+			"\t}\n" +
+			"\t# a comment with a } bracket\n" +
+			"\techo '{' \\} ${#POUL_SRC}\n" +
+			"\tbuild \"$POUL_SRC\"\n",
+		"\tpython3 - <<'EOF'\n" +
+			"if True:\n" +
+			"    print(\"don't {\")\n" +
+			"EOF\n",
+	}
+	if len(program.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(program.Steps))
+	}
+	for index, code := range expected {
+		if program.Steps[index].Code != code {
+			t.Errorf("expected code\n%s\ngot\n%s", code, program.Steps[index].Code)
+		}
+	}
+
+	_, err = Parse(`
+src/$1 -> dist/$1 {
+	echo "}"
+	if true; then {
+		echo
+	}
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2 for unterminated block, got %v", err)
+	}
+
+	_, err = Parse(`
+src/$1 -> dist/$1 {
+	echo
+} foo
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 4 {
+		t.Errorf("expected ParseError at line 4, got %v", err)
+	}
+
+	// Apostrophes outside of shell quoting don't hide the end of a block
+	program, err = Parse(`
+src/$1.txt -> dist/$1.txt {
+	cat > $POUL_DEST <<EOF
+	don't
+	EOF
+}
+
+src/$1.js -> dist/$1.js @shell node {
+	if (true) {
+		// don't do this
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"\tcat > $POUL_DEST <<EOF\n\tdon't\n\tEOF\n",
+		"\tif (true) {\n\t\t// don't do this\n\t}\n",
+	}
+	if len(program.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(program.Steps))
+	}
+	for index, code := range expected {
+		if program.Steps[index].Code != code {
+			t.Errorf("expected code\n%s\ngot\n%s", code, program.Steps[index].Code)
+		}
+	}
+
+	// Neither unbalanced brackets nor quotes hide a closing bracket at
+	// the indentation of the header
+	program, err = Parse(`
+src/$1.txt -> dist/$1.txt {
+	cat > $POUL_DEST <<EOF
+	{
+	EOF
+	echo a#{b
+	sed s/{/x/ $POUL_SRC
+}
+
+src/$1.js -> dist/$1.js @shell node {
+	// don't
+	if (x) {
+		y()
+	}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"\tcat > $POUL_DEST <<EOF\n\t{\n\tEOF\n\techo a#{b\n\tsed s/{/x/ $POUL_SRC\n",
+		"\t// don't\n\tif (x) {\n\t\ty()\n\t}\n",
+	}
+	if len(program.Steps) != len(expected) {
+		t.Fatalf("expected %d steps, got %d", len(expected), len(program.Steps))
+	}
+	for index, code := range expected {
+		if program.Steps[index].Code != code {
+			t.Errorf("expected code\n%s\ngot\n%s", code, program.Steps[index].Code)
+		}
+	}
+}
+
+func TestParserShell(t *testing.T) {
+	program, err := Parse(`
+src/$1.py (lib/*.py) -> dist/$1.json @shell python3 -u {
+	import os
+	print(os.environ["POUL_SRC"])
+}
+
+phony greet @shell bash {
+	echo "hello"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"src/$1.py (lib/*.py) -> dist/$1.json @shell python3 -u",
+		"phony greet @shell bash",
+	}
+	for index, header := range expected {
+		if program.Steps[index].String() != header {
+			t.Errorf("expected step %s, got %s", header, program.Steps[index])
+		}
+	}
+	if shell := program.Steps[0].Shell; shell != "python3 -u" {
+		t.Errorf("unexpected shell: %s", shell)
+	}
+
+	_, err = Parse(`
+all @shell bash {
+	dist/app.js
+}
+`)
+	if perr, ok := err.(ParseError); !ok || perr.Line != 2 {
+		t.Errorf("expected ParseError at line 2, got %v", err)
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,6 +18,23 @@ import (
 
 var (
 	stderr = log.New(os.Stderr, "--> ", 0)
+
+	forceFlag = cli.BoolFlag{
+		Name:  "force, B",
+		Usage: "run all steps, even if their destinations are up to date",
+	}
+
+	dryRunFlag = cli.BoolFlag{
+		Name:  "dry-run, n",
+		Usage: "print the steps which would run instead of running them",
+	}
+
+	jobsFlag = cli.IntFlag{
+		Name:   "jobs, j",
+		Value:  1,
+		Usage:  "run up to N independent steps at the same time",
+		EnvVar: "POUL_JOBS",
+	}
 )
 
 func init() {
@@ -39,16 +57,70 @@ func main() {
 			Name:   "compile",
 			Usage:  "compile a source file",
 			Action: compile,
+			Flags: []cli.Flag{
+				forceFlag,
+				jobsFlag,
+				dryRunFlag,
+			},
 		},
 		{
 			Name:   "build",
 			Usage:  "build a destination",
 			Action: build,
+			Flags: []cli.Flag{
+				forceFlag,
+				jobsFlag,
+				dryRunFlag,
+			},
 		},
 		{
 			Name:   "run",
-			Usage:  "run a templte",
+			Usage:  "run a template or phony step",
 			Action: run,
+			Flags: []cli.Flag{
+				forceFlag,
+				jobsFlag,
+				dryRunFlag,
+			},
+		},
+		{
+			Name:   "graph",
+			Usage:  "print the build graph, optionally limited to a template or destination",
+			Action: graph,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "dot",
+					Usage: "output format, either dot or json",
+				},
+			},
+		},
+		{
+			Name:   "explain",
+			Usage:  "explain which steps use a file and whether it would be rebuilt",
+			Action: explain,
+		},
+		{
+			Name:   "list",
+			Usage:  "list templates, steps and the destinations they currently produce",
+			Action: list,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the list as JSON",
+				},
+			},
+		},
+		{
+			Name:   "clean",
+			Usage:  "remove all generated destinations or the ones required by a template",
+			Action: clean,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "print the files which would be removed instead of removing them",
+				},
+			},
 		},
 		{
 			Name:   "watch",
@@ -60,6 +132,7 @@ func main() {
 					Usage:  "exclude directories from being watched",
 					EnvVar: "POUL_EXCLUDE",
 				},
+				jobsFlag,
 			},
 		},
 	}
@@ -71,6 +144,12 @@ func main() {
 			Usage:  "change the Poulfile to read from",
 			EnvVar: "POUL_FILE",
 		},
+		cli.StringFlag{
+			Name:   "state",
+			Value:  "./.poul/state",
+			Usage:  "change the file storing the build state, an empty value compares modification times instead",
+			EnvVar: "POUL_STATE",
+		},
 	}
 
 	app.Run(os.Args)
@@ -87,15 +166,11 @@ func dump(c *cli.Context) {
 
 func readPoulfile(c *cli.Context) *program.Program {
 	name := c.GlobalString("file")
-	b, err := ioutil.ReadFile(name)
+	prog, err := parser.ParseFile(name, variables(c))
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Fatalf("unable to read poulfile: file '%s' does not exist", name)
 		}
-		panic(err)
-	}
-	prog, err := parser.Parse(string(b))
-	if err != nil {
 		if perr, ok := err.(parser.ParseError); ok {
 			log.Fatalf("unable to parse poulfile: %s", perr)
 		}
@@ -104,12 +179,82 @@ func readPoulfile(c *cli.Context) *program.Program {
 	return prog
 }
 
+// Split the arguments into variable overrides, e.g. OUT=build, and the
+// remaining ones.
+func splitArgs(c *cli.Context) (map[string]string, []string) {
+	variables := make(map[string]string)
+	args := make([]string, 0, len(c.Args()))
+	for _, arg := range c.Args() {
+		if result := parser.ReVariable.FindStringSubmatch(arg); result != nil {
+			variables[result[1]] = result[2]
+			continue
+		}
+		args = append(args, arg)
+	}
+	return variables, args
+}
+
+func variables(c *cli.Context) map[string]string {
+	variables, _ := splitArgs(c)
+	return variables
+}
+
+func arguments(c *cli.Context) []string {
+	_, args := splitArgs(c)
+	return args
+}
+
+func readGraph(prog *program.Program) *program.Graph {
+	buildGraph, err := program.NewGraph(*prog)
+	checkGraphError(err)
+	return buildGraph
+}
+
+func checkGraphError(err error) {
+	if err != nil {
+		if cerr, ok := err.(program.CycleError); ok {
+			log.Fatalf("invalid poulfile: %s", cerr)
+		}
+		panic(err)
+	}
+}
+
+func loadState(c *cli.Context, prog *program.Program) {
+	name := c.GlobalString("state")
+	if name == "" {
+		return
+	}
+	state, err := program.LoadState(name)
+	if err != nil {
+		log.Fatalf("unable to read state: %s", err)
+	}
+	prog.State = state
+}
+
+func saveState(prog *program.Program) {
+	if prog.State == nil || prog.DryRun != nil {
+		return
+	}
+	if err := prog.State.Save(); err != nil {
+		log.Fatalf("unable to write state: %s", err)
+	}
+}
+
 func compile(c *cli.Context) {
-	if len(c.Args()) < 0 {
+	args := arguments(c)
+	if len(args) < 0 {
 		log.Fatal("no source file(s) supplied.")
 	}
 	prog := readPoulfile(c)
-	code, err := prog.CompileMulti(c.Args()[0:])
+	readGraph(prog)
+	prog.Force = c.Bool("force")
+	prog.Jobs = c.Int("jobs")
+	if c.Bool("dry-run") {
+		prog.DryRun = os.Stdout
+	}
+	loadState(c, prog)
+	code, err := prog.CompileMulti(args)
+	saveState(prog)
 	if err != nil {
 		if err == program.ErrNoMatch {
 			log.Fatal("no build step found.")
@@ -120,11 +265,20 @@ func compile(c *cli.Context) {
 }
 
 func build(c *cli.Context) {
-	if len(c.Args()) < 0 {
+	args := arguments(c)
+	if len(args) < 0 {
 		log.Fatal("no destination(s) supplied.")
 	}
 	prog := readPoulfile(c)
-	code, err := prog.BuildMulti(c.Args()[0:])
+	readGraph(prog)
+	prog.Force = c.Bool("force")
+	prog.Jobs = c.Int("jobs")
+	if c.Bool("dry-run") {
+		prog.DryRun = os.Stdout
+	}
+	loadState(c, prog)
+	code, err := prog.BuildMulti(args)
+	saveState(prog)
 	if err != nil {
 		panic(err)
 	}
@@ -132,24 +286,264 @@ func build(c *cli.Context) {
 }
 
 func run(c *cli.Context) {
-	if len(c.Args()) < 0 {
+	args := arguments(c)
+	if len(args) < 0 {
 		log.Fatal("no template supplied.")
 	}
 	prog := readPoulfile(c)
-	code, err := prog.RunTemplate(c.Args()[0])
+	readGraph(prog)
+	prog.Force = c.Bool("force")
+	prog.Jobs = c.Int("jobs")
+	if c.Bool("dry-run") {
+		prog.DryRun = os.Stdout
+	}
+	loadState(c, prog)
+
+	// Phony steps can be run like templates
+	name := args[0]
+	phony := false
+	if _, ok := prog.Templates[name]; !ok {
+		var err error
+		phony, err = prog.IsPhony(name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var code int
+	var err error
+	if phony {
+		code, err = prog.Build(name)
+	} else {
+		code, err = prog.RunTemplate(name)
+	}
+	saveState(prog)
 	if err != nil {
 		panic(err)
 	}
 	os.Exit(code)
 }
 
+func graph(c *cli.Context) {
+	args := arguments(c)
+	prog := readPoulfile(c)
+	buildGraph := readGraph(prog)
+
+	var err error
+	if len(args) > 0 {
+		buildGraph, err = buildGraph.Subgraph(args[0])
+		checkGraphError(err)
+	}
+
+	switch c.String("format") {
+	case "dot":
+		err = buildGraph.WriteDot(os.Stdout)
+	case "json":
+		var b []byte
+		b, err = json.MarshalIndent(buildGraph, "", "\t")
+		if err == nil {
+			_, err = fmt.Println(string(b))
+		}
+	default:
+		log.Fatalf("unknown format '%s', expected dot or json", c.String("format"))
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func explain(c *cli.Context) {
+	args := arguments(c)
+	if len(args) == 0 {
+		log.Fatal("no file supplied.")
+	}
+	prog := readPoulfile(c)
+	loadState(c, prog)
+
+	for _, file := range args {
+		explanation, err := prog.Explain(file)
+		if err != nil {
+			panic(err)
+		}
+		printExplanation(explanation)
+	}
+}
+
+func printExplanation(explanation program.Explanation) {
+	fmt.Printf("%s\n", explanation.File)
+
+	fmt.Println("  compiled as source by:")
+	for _, match := range explanation.Sources {
+		printExplainedMatch(match, "")
+	}
+	if len(explanation.Sources) == 0 {
+		fmt.Println("    no step")
+	}
+
+	fmt.Println("  built as destination by:")
+	for index, match := range explanation.Destinations {
+		note := ""
+		if index == 0 {
+			note = " (used)"
+		}
+		printExplainedMatch(match, note)
+	}
+	if len(explanation.Destinations) == 0 {
+		fmt.Println("    no step")
+	}
+	if explanation.Ambiguous {
+		fmt.Println("    warning: the first two steps are equally specific, the earlier one is used")
+	}
+
+	fmt.Println("  dependency of:")
+	for _, step := range explanation.Dependents {
+		fmt.Printf("    %s\n", step)
+	}
+	if len(explanation.Dependents) == 0 {
+		fmt.Println("    no step")
+	}
+}
+
+func printExplainedMatch(match program.ExplainedMatch, note string) {
+	fmt.Printf("    %s%s\n", match.Step, note)
+	dests := match.Step.Destinations(match.Destination, match.Args)
+	fmt.Printf("      %s -> %s\n", match.Source, strings.Join(dests, ", "))
+	env, err := match.Environment()
+	if err != nil {
+		panic(err)
+	}
+	for _, value := range env {
+		if strings.HasPrefix(value, "POUL_ARG_") {
+			fmt.Printf("      %s\n", value)
+		}
+	}
+	state := "up to date"
+	if match.Stale {
+		state = "stale"
+	}
+	fmt.Printf("      %s: %s\n", state, match.Reason)
+}
+
+type listing struct {
+	Templates []program.Template
+	Steps     []listedStep
+}
+
+type listedStep struct {
+	program.Step
+	Targets []listedTarget
+}
+
+type listedTarget struct {
+	Source       string
+	Destinations []string
+	Args         map[string]string
+}
+
+func list(c *cli.Context) {
+	prog := readPoulfile(c)
+
+	names := make([]string, 0, len(prog.Templates))
+	for name := range prog.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := listing{
+		Templates: make([]program.Template, 0, len(names)),
+		Steps:     make([]listedStep, 0, len(prog.Steps)),
+	}
+	for _, name := range names {
+		result.Templates = append(result.Templates, prog.Templates[name])
+	}
+	for _, step := range prog.Steps {
+		matches, err := step.FindSources()
+		if err != nil {
+			panic(err)
+		}
+		item := listedStep{
+			Step:    step,
+			Targets: make([]listedTarget, 0, len(matches)),
+		}
+		for _, match := range matches {
+			item.Targets = append(item.Targets, listedTarget{
+				Source:       match.Source,
+				Destinations: step.Destinations(match.Destination, match.Args),
+				Args:         match.Args,
+			})
+		}
+		result.Steps = append(result.Steps, item)
+	}
+
+	if c.Bool("json") {
+		b, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	fmt.Println("templates:")
+	for _, tpl := range result.Templates {
+		hooks := ""
+		if len(tpl.Prehooks) > 0 || len(tpl.Posthooks) > 0 {
+			hooks = fmt.Sprintf(" (%s / %s)", strings.Join(tpl.Prehooks, ", "), strings.Join(tpl.Posthooks, ", "))
+		}
+		fmt.Printf("  %s%s\n", tpl.Name, hooks)
+	}
+
+	fmt.Println("steps:")
+	for _, item := range result.Steps {
+		fmt.Printf("  %s\n", item.Step)
+		for _, target := range item.Targets {
+			fmt.Printf("    %s -> %s\n", target.Source, strings.Join(target.Destinations, ", "))
+		}
+	}
+}
+
+func clean(c *cli.Context) {
+	args := arguments(c)
+	prog := readPoulfile(c)
+	buildGraph := readGraph(prog)
+
+	if len(args) > 0 {
+		name := args[0]
+		if _, ok := prog.Templates[name]; !ok {
+			log.Fatalf("template '%s' does not exist", name)
+		}
+		var err error
+		buildGraph, err = buildGraph.Subgraph(name)
+		checkGraphError(err)
+	}
+
+	if c.Bool("dry-run") {
+		prog.DryRun = os.Stdout
+	}
+
+	removed, err := prog.Clean(buildGraph.Generated())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prog.DryRun == nil {
+		for _, file := range removed {
+			stderr.Printf("Removed '%s'.\n", file)
+		}
+	}
+}
+
 func watch(c *cli.Context) {
+	args := arguments(c)
 	prog := readPoulfile(c)
+	readGraph(prog)
+	prog.Jobs = c.Int("jobs")
+	loadState(c, prog)
 	dir := "./"
-	if len(c.Args()) > 0 {
-		dir = c.Args()[0]
+	if len(args) > 0 {
+		dir = args[0]
 	}
 	excludes := excludeMap(c.String("exclude"))
+	stateFile := filepath.Clean(c.GlobalString("state"))
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -164,7 +558,8 @@ func watch(c *cli.Context) {
 		for {
 			select {
 			case evt := <-watcher.Events:
-				if !isChangeOp(evt.Op) {
+				// Writing the state must not trigger another compilation
+				if !isChangeOp(evt.Op) || filepath.Clean(evt.Name) == stateFile {
 					continue
 				}
 				recentChanges[evt.Name] = time.Now()
@@ -231,6 +626,8 @@ func processFile(prog *program.Program, fileName string) {
 	stderr.Println("Recompiling sources by dependency...")
 	code, err = prog.CompileByDependency(fileName)
 	processCompilation(code, err, "Not as dependency used.")
+
+	saveState(prog)
 }
 
 func processCompilation(code int, err error, message string) {
@@ -0,0 +1,49 @@
+package program
+
+import (
+	"fmt"
+	"os"
+)
+
+// Generated returns the files in the graph which are built by a step.
+func (graph *Graph) Generated() []string {
+	files := make([]string, 0)
+	for _, node := range graph.Nodes {
+		if node.Kind == FileNode && len(node.Requires) > 0 {
+			files = append(files, node.Name)
+		}
+	}
+	return files
+}
+
+// Clean removes the given generated files and returns the ones which have
+// been removed. Missing files, directories and special files, e.g.
+// /dev/null, are never removed. If DryRun is set, the files are written
+// to it instead of being removed.
+func (prog Program) Clean(files []string) ([]string, error) {
+	removed := make([]string, 0)
+	for _, file := range files {
+		info, err := os.Lstat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		if prog.DryRun != nil {
+			if _, err := fmt.Fprintln(prog.DryRun, file); err != nil {
+				return removed, err
+			}
+		} else if err := os.Remove(file); err != nil {
+			return removed, err
+		}
+		removed = append(removed, file)
+	}
+
+	return removed, nil
+}
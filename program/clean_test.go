@@ -0,0 +1,42 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := Program{}.Clean([]string{
+		file,
+		filepath.Join(dir, "missing"),
+		dir,
+		os.DevNull,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{file}) {
+		t.Errorf("unexpected removed files: %v", removed)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", file)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("expected %s to be kept", dir)
+	}
+}
@@ -0,0 +1,68 @@
+package program
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describe the planned matches which would run instead of running them.
+// A match also runs if one of the matches it requires does, because its
+// inputs would change.
+func (prog Program) dryRunPlan(p *plan) (int, error) {
+	runs := make([]bool, len(p.matches))
+	for index, match := range p.matches {
+		reason := ""
+		for _, prerequisite := range p.after[index] {
+			if runs[prerequisite] {
+				reason = fmt.Sprintf("input '%s' would be rebuilt", p.matches[prerequisite].Destination)
+				break
+			}
+		}
+
+		if reason == "" {
+			if prog.Force {
+				reason = "forced"
+			} else {
+				stale, staleReason, err := prog.Stale(match.Step, match.Source, match.Destination, match.Args)
+				if err != nil {
+					return -1, err
+				}
+				if !stale {
+					continue
+				}
+				reason = staleReason
+			}
+		}
+
+		runs[index] = true
+		if err := prog.describe(match, reason); err != nil {
+			return -1, err
+		}
+	}
+
+	return 0, nil
+}
+
+// Write the environment and code of a match to the dry run output.
+func (prog Program) describe(match StepMatch, reason string) error {
+	env, err := prog.Environment(match)
+	if err != nil {
+		return err
+	}
+
+	header := strings.Join(match.Step.Destinations(match.Destination, match.Args), ", ")
+	if match.Source != "" {
+		header = match.Source + " -> " + header
+	}
+	lines := []string{
+		fmt.Sprintf("# %s (%s)", header, reason),
+	}
+	lines = append(lines, env...)
+	if match.Step.Shell != "" {
+		lines = append(lines, "# "+ShellAttribute+" "+match.Step.Shell)
+	}
+	lines = append(lines, strings.TrimSpace(dedent(match.Step.Code)), "")
+
+	_, err = fmt.Fprintln(prog.DryRun, strings.Join(lines, "\n"))
+	return err
+}
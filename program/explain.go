@@ -0,0 +1,82 @@
+package program
+
+import "path"
+
+// Explanation describes how the steps of a program use a file.
+type Explanation struct {
+	File string
+	// Steps compiling the file as source
+	Sources []ExplainedMatch
+	// Steps building the file as destination by precedence, the first
+	// one is used. Ambiguous is set if the first two are equally specific.
+	Destinations []ExplainedMatch
+	Ambiguous    bool
+	// Steps listing the file in their dependencies
+	Dependents []Step
+}
+
+// ExplainedMatch is a step match together with whether and why its
+// destination has to be rebuilt.
+type ExplainedMatch struct {
+	StepMatch
+	Stale  bool
+	Reason string
+}
+
+// Explain finds the steps using file as source, destination or
+// dependency and checks whether their destinations are up to date.
+func (prog Program) Explain(file string) (Explanation, error) {
+	file = path.Clean(file)
+	explanation := Explanation{
+		File:         file,
+		Sources:      make([]ExplainedMatch, 0),
+		Destinations: make([]ExplainedMatch, 0),
+		Dependents:   make([]Step, 0),
+	}
+
+	for _, step := range prog.Steps {
+		args, matches, err := step.Compiles(file)
+		if err != nil {
+			return explanation, err
+		}
+		if matches {
+			match, err := prog.explainMatch(step.Match(file, args))
+			if err != nil {
+				return explanation, err
+			}
+			explanation.Sources = append(explanation.Sources, match)
+		}
+
+		depends, err := step.DependsOn(file)
+		if err != nil {
+			return explanation, err
+		}
+		if depends {
+			explanation.Dependents = append(explanation.Dependents, step)
+		}
+	}
+
+	builders, ambiguous, err := prog.Builders(file)
+	if err != nil {
+		return explanation, err
+	}
+	explanation.Ambiguous = ambiguous
+	for _, builder := range builders {
+		match, err := prog.explainMatch(builder)
+		if err != nil {
+			return explanation, err
+		}
+		explanation.Destinations = append(explanation.Destinations, match)
+	}
+
+	return explanation, nil
+}
+
+func (prog Program) explainMatch(match StepMatch) (ExplainedMatch, error) {
+	stale, reason, err := prog.Stale(match.Step, match.Source, match.Destination, match.Args)
+	return ExplainedMatch{
+		StepMatch: match,
+		Stale:     stale,
+		Reason:    reason,
+	}, err
+}
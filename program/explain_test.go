@@ -0,0 +1,47 @@
+package program
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	explanation, err := chainProg.Explain("./build/foo.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if explanation.File != "build/foo.js" {
+		t.Errorf("unexpected file: %s", explanation.File)
+	}
+
+	if len(explanation.Sources) != 1 {
+		t.Fatalf("expected one source match, got %d", len(explanation.Sources))
+	}
+	source := explanation.Sources[0]
+	if source.Destination != "dist/foo.min.js" || !reflect.DeepEqual(source.Args, map[string]string{"1": "foo"}) {
+		t.Errorf("unexpected source match: %v", source)
+	}
+	if !source.Stale || source.Reason == "" {
+		t.Errorf("expected missing destination to be stale: %v", source)
+	}
+
+	if len(explanation.Destinations) != 1 {
+		t.Fatalf("expected one destination match, got %d", len(explanation.Destinations))
+	}
+	if dest := explanation.Destinations[0]; dest.Source != "src/foo.ts" {
+		t.Errorf("unexpected destination match: %v", dest)
+	}
+
+	if len(explanation.Dependents) != 0 {
+		t.Errorf("expected no dependents, got %v", explanation.Dependents)
+	}
+
+	explanation, err = chainProg.Explain("build/tsconfig.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanation.Dependents) != 1 || explanation.Dependents[0].Source != "src/$1.ts" {
+		t.Errorf("unexpected dependents: %v", explanation.Dependents)
+	}
+}
@@ -0,0 +1,157 @@
+package program
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Acconut/poul/glob"
+)
+
+// Stale reports whether dest, or another destination built by the same
+// run, has to be rebuilt because it is missing or older than the source
+// or one of the step's dependencies. The returned string describes the
+// reason.
+func (step Step) Stale(source, dest string, args map[string]string) (bool, string, error) {
+	// Compare the inputs to the oldest destination
+	var oldest os.FileInfo
+	for _, output := range step.Destinations(dest, args) {
+		stale, reason, err := destinationStale(output)
+		if stale || err != nil {
+			return stale, reason, err
+		}
+
+		info, err := os.Stat(output)
+		if err != nil {
+			return false, "", err
+		}
+		if oldest == nil || info.ModTime().Before(oldest.ModTime()) {
+			oldest, dest = info, output
+		}
+	}
+
+	inputs, err := step.Inputs(source, args)
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, input := range inputs {
+		inputInfo, err := os.Stat(input)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return true, fmt.Sprintf("input '%s' does not exist", input), nil
+			}
+			return false, "", err
+		}
+
+		if inputInfo.ModTime().After(oldest.ModTime()) {
+			return true, fmt.Sprintf("input '%s' is newer than destination '%s'", input, dest), nil
+		}
+	}
+
+	return false, fmt.Sprintf("destination '%s' is up to date", dest), nil
+}
+
+// Check whether dest is missing or no regular file. Special files, e.g.
+// /dev/null, and directories are never considered up to date.
+func destinationStale(dest string) (bool, string, error) {
+	info, err := os.Stat(dest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, fmt.Sprintf("destination '%s' does not exist", dest), nil
+		}
+		return false, "", err
+	}
+
+	if !info.Mode().IsRegular() {
+		return true, fmt.Sprintf("destination '%s' is not a regular file", dest), nil
+	}
+
+	return false, "", nil
+}
+
+// Inputs returns the files the step reads when compiling source, i.e.
+// the source files followed by all files matched by the dependencies
+// which are not excluded. The source's arguments are substituted in the
+// dependencies.
+func (step Step) Inputs(source string, args map[string]string) ([]string, error) {
+	inputs, err := step.Sources(source)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, excludes := step.dependencyPatterns(args)
+	for _, dep := range includes {
+		files, err := expand(dep)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			excluded, err := matchesAny(excludes, file)
+			if err != nil {
+				return nil, err
+			}
+			if !excluded {
+				inputs = append(inputs, file)
+			}
+		}
+	}
+
+	return inputs, nil
+}
+
+// Sources returns the files a match of the step compiles. The source is
+// usually a file, which may not exist yet, whose name must not be
+// interpreted as pattern. Only for aggregating steps it is expanded into
+// all matching files which are not excluded.
+func (step Step) Sources(source string) ([]string, error) {
+	// Phony steps may have no source
+	if source == "" {
+		return nil, nil
+	}
+
+	if !step.Aggregate {
+		return []string{source}, nil
+	}
+
+	files, err := expand(source)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]string, 0, len(files))
+	for _, file := range files {
+		excluded, err := matchesAny(step.Excludes, file)
+		if err != nil {
+			return nil, err
+		}
+		if !excluded {
+			sources = append(sources, file)
+		}
+	}
+	return sources, nil
+}
+
+// Expand a pattern into the files it currently matches. A literal
+// pattern is returned as is, even if the file does not exist yet.
+func expand(patternStr string) ([]string, error) {
+	pattern, err := glob.NewPattern(patternStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if text, ok := pattern.Literal(); ok {
+		return []string{text}, nil
+	}
+
+	entries, err := pattern.Glob()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, len(entries))
+	for index, entry := range entries {
+		files[index] = entry.Name
+	}
+	return files, nil
+}
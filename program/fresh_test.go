@@ -0,0 +1,72 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	dep := filepath.Join(dir, "dep")
+	dest := filepath.Join(dir, "dest")
+
+	step := Step{
+		Dependencies: []string{dep},
+	}
+
+	touch := func(name string, mtime time.Time) {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	touch(source, now.Add(-2*time.Hour))
+	touch(dep, now.Add(-2*time.Hour))
+
+	// Missing destination
+	if stale, _, err := step.Stale(source, dest, nil); err != nil || !stale {
+		t.Errorf("expected missing destination to be stale (%s)", err)
+	}
+
+	// Up to date destination
+	touch(dest, now.Add(-1*time.Hour))
+	if stale, _, err := step.Stale(source, dest, nil); err != nil || stale {
+		t.Errorf("expected destination to be up to date (%s)", err)
+	}
+
+	// Newer dependency
+	touch(dep, now)
+	if stale, _, err := step.Stale(source, dest, nil); err != nil || !stale {
+		t.Errorf("expected newer dependency to make destination stale (%s)", err)
+	}
+
+	// Missing further destination
+	step.Outputs = []string{dest + ".map"}
+	touch(dep, now.Add(-2*time.Hour))
+	if stale, _, err := step.Stale(source, dest, nil); err != nil || !stale {
+		t.Errorf("expected missing output to make destination stale (%s)", err)
+	}
+	touch(dest+".map", now.Add(-1*time.Hour))
+	if stale, _, err := step.Stale(source, dest, nil); err != nil || stale {
+		t.Errorf("expected destinations to be up to date (%s)", err)
+	}
+	step.Outputs = nil
+
+	// Special files are always stale
+	if stale, _, err := step.Stale(source, os.DevNull, nil); err != nil || !stale {
+		t.Errorf("expected %s to be stale (%s)", os.DevNull, err)
+	}
+}
@@ -0,0 +1,359 @@
+package program
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TemplateNode = "template"
+	StepNode     = "step"
+	FileNode     = "file"
+	PhonyNode    = "phony"
+)
+
+// A Node is either a template, a step building a concrete destination,
+// a file or the name of a phony step. Requires contains the IDs of the
+// nodes it depends on.
+type Node struct {
+	ID       string
+	Kind     string
+	Name     string
+	Requires []string
+}
+
+func (node Node) String() string {
+	return node.Kind + " '" + node.Name + "'"
+}
+
+// Graph is the build graph of a program. Nodes are sorted in the order
+// they have been discovered.
+type Graph struct {
+	Nodes []*Node
+	nodes map[string]*Node
+	prog  Program
+}
+
+// CycleError is returned if a template, step or file requires itself.
+// Cycle lists the nodes forming the loop, starting and ending with the
+// same one.
+type CycleError struct {
+	Cycle []string
+}
+
+// Identify a step match by its source and destination. Phony steps
+// without source are identified by their name.
+func matchKey(match StepMatch) string {
+	if match.Source == "" {
+		return path.Clean(match.Destination)
+	}
+	return path.Clean(match.Source) + " -> " + path.Clean(match.Destination)
+}
+
+func newCycleError(kind string, names []string) CycleError {
+	cycle := make([]string, len(names))
+	for index, name := range names {
+		cycle[index] = Node{Kind: kind, Name: name}.String()
+	}
+	return CycleError{cycle}
+}
+
+func (err CycleError) Error() string {
+	return "program: dependency cycle: " + strings.Join(err.Cycle, " -> ")
+}
+
+// NewGraph builds the graph of all templates and of all steps whose
+// sources currently exist, including the steps they transitively
+// require. A CycleError is returned if the graph contains a loop.
+func NewGraph(prog Program) (*Graph, error) {
+	graph := &Graph{
+		Nodes: make([]*Node, 0),
+		nodes: make(map[string]*Node),
+		prog:  prog,
+	}
+
+	names := make([]string, 0, len(prog.Templates))
+	for name := range prog.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := graph.addTemplate(name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, step := range prog.Steps {
+		matches, err := step.FindSources()
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if _, err := graph.addMatch(match); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := graph.checkCycles(); err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
+// Node returns the node with the given ID or nil.
+func (graph *Graph) Node(id string) *Node {
+	return graph.nodes[id]
+}
+
+// Subgraph returns the part of the graph reachable from the template or
+// file called name. Files which are not part of the graph yet are added.
+func (graph *Graph) Subgraph(name string) (*Graph, error) {
+	var root *Node
+	if _, ok := graph.prog.Templates[name]; ok {
+		root = graph.nodes[TemplateNode+":"+name]
+	} else {
+		var err error
+		root, err = graph.addFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := graph.checkCycles(); err != nil {
+			return nil, err
+		}
+	}
+
+	subgraph := &Graph{
+		Nodes: make([]*Node, 0),
+		nodes: make(map[string]*Node),
+		prog:  graph.prog,
+	}
+
+	var visit func(node *Node)
+	visit = func(node *Node) {
+		if _, ok := subgraph.nodes[node.ID]; ok {
+			return
+		}
+		subgraph.nodes[node.ID] = node
+		subgraph.Nodes = append(subgraph.Nodes, node)
+		for _, id := range node.Requires {
+			visit(graph.nodes[id])
+		}
+	}
+	visit(root)
+
+	return subgraph, nil
+}
+
+// WriteDot writes the graph in Graphviz's DOT language. Edges point from
+// a node to the nodes it requires.
+func (graph *Graph) WriteDot(w io.Writer) error {
+	shapes := map[string]string{
+		TemplateNode: "box",
+		StepNode:     "ellipse",
+		FileNode:     "note",
+		PhonyNode:    "diamond",
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph poul {"); err != nil {
+		return err
+	}
+
+	for _, node := range graph.Nodes {
+		_, err := fmt.Fprintf(w, "\t%s [label=%s, shape=%s];\n", strconv.Quote(node.ID), strconv.Quote(node.Name), shapes[node.Kind])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, node := range graph.Nodes {
+		for _, id := range node.Requires {
+			_, err := fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(node.ID), strconv.Quote(id))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// Add a node if it does not exist yet. It reports whether it was added.
+func (graph *Graph) add(kind, name string) (*Node, bool) {
+	id := kind + ":" + name
+	if node, ok := graph.nodes[id]; ok {
+		return node, false
+	}
+
+	node := &Node{
+		ID:       id,
+		Kind:     kind,
+		Name:     name,
+		Requires: make([]string, 0),
+	}
+	graph.nodes[id] = node
+	graph.Nodes = append(graph.Nodes, node)
+	return node, true
+}
+
+func (graph *Graph) addTemplate(name string) (*Node, error) {
+	node, added := graph.add(TemplateNode, name)
+	if !added {
+		return node, nil
+	}
+
+	tpl, ok := graph.prog.Templates[name]
+	if !ok {
+		return node, nil
+	}
+
+	for _, hook := range tpl.Prehooks {
+		hookNode, err := graph.addTemplate(hook)
+		if err != nil {
+			return nil, err
+		}
+		node.Requires = append(node.Requires, hookNode.ID)
+	}
+
+	dests, err := graph.prog.TemplateDestinations(tpl)
+	if err != nil {
+		return nil, err
+	}
+	for _, dest := range dests {
+		fileNode, err := graph.addFile(dest)
+		if err != nil {
+			return nil, err
+		}
+		node.Requires = append(node.Requires, fileNode.ID)
+	}
+
+	for _, hook := range tpl.Posthooks {
+		hookNode, err := graph.addTemplate(hook)
+		if err != nil {
+			return nil, err
+		}
+		node.Requires = append(node.Requires, hookNode.ID)
+	}
+
+	return node, nil
+}
+
+func (graph *Graph) addFile(name string) (*Node, error) {
+	match, ok, err := graph.prog.builder(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		node, _ := graph.add(FileNode, path.Clean(name))
+		return node, nil
+	}
+
+	node, added := graph.add(destinationKind(match.Step), path.Clean(name))
+	if !added {
+		return node, nil
+	}
+
+	// The step node registers itself as requirement of this node
+	if _, err := graph.addMatch(match); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// The kind of the nodes for destinations built by step.
+func destinationKind(step Step) string {
+	if step.Phony {
+		return PhonyNode
+	}
+	return FileNode
+}
+
+func (graph *Graph) addMatch(match StepMatch) (*Node, error) {
+	node, added := graph.add(StepNode, matchKey(match))
+	if !added {
+		return node, nil
+	}
+
+	// Register the destinations so they point to this step
+	for _, dest := range match.Step.Destinations(match.Destination, match.Args) {
+		destNode, _ := graph.add(destinationKind(match.Step), path.Clean(dest))
+		if len(destNode.Requires) == 0 {
+			destNode.Requires = append(destNode.Requires, node.ID)
+		}
+	}
+
+	inputs, err := match.Step.Inputs(match.Source, match.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, input := range inputs {
+		fileNode, err := graph.addFile(input)
+		if err != nil {
+			return nil, err
+		}
+		node.Requires = append(node.Requires, fileNode.ID)
+	}
+
+	return node, nil
+}
+
+// Search the graph for a loop using a depth-first search.
+func (graph *Graph) checkCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+	stack := make([]*Node, 0)
+
+	var visit func(node *Node) error
+	visit = func(node *Node) error {
+		switch state[node.ID] {
+		case visited:
+			return nil
+		case visiting:
+			// Collect the nodes from the first occurrence on
+			cycle := make([]string, 0)
+			for index := len(stack) - 1; index >= 0; index-- {
+				if stack[index] == node {
+					for _, item := range stack[index:] {
+						cycle = append(cycle, item.String())
+					}
+					break
+				}
+			}
+			return CycleError{append(cycle, node.String())}
+		}
+
+		state[node.ID] = visiting
+		stack = append(stack, node)
+		for _, id := range node.Requires {
+			if err := visit(graph.nodes[id]); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[node.ID] = visited
+		return nil
+	}
+
+	for _, node := range graph.Nodes {
+		if err := visit(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
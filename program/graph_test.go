@@ -0,0 +1,113 @@
+package program
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	prog := chainProg
+	prog.Templates = map[string]Template{
+		"all": Template{
+			Name:         "all",
+			Prehooks:     []string{"clean"},
+			Destinations: []string{"dist/foo.min.js"},
+		},
+		"clean": Template{
+			Name: "clean",
+		},
+	}
+
+	graph, err := NewGraph(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"template:all":                              []string{"template:clean", "file:dist/foo.min.js"},
+		"template:clean":                            []string{},
+		"file:dist/foo.min.js":                      []string{"step:build/foo.js -> dist/foo.min.js"},
+		"step:build/foo.js -> dist/foo.min.js":      []string{"file:build/foo.js"},
+		"file:build/foo.js":                         []string{"step:src/foo.ts -> build/foo.js"},
+		"step:src/foo.ts -> build/foo.js":           []string{"file:src/foo.ts", "file:build/tsconfig.json"},
+		"file:src/foo.ts":                           []string{},
+		"file:build/tsconfig.json":                  []string{"step:tsconfig.json -> build/tsconfig.json"},
+		"step:tsconfig.json -> build/tsconfig.json": []string{"file:tsconfig.json"},
+		"file:tsconfig.json":                        []string{},
+	}
+
+	if len(graph.Nodes) != len(expected) {
+		t.Errorf("expected %d nodes, got %d", len(expected), len(graph.Nodes))
+	}
+	for id, requires := range expected {
+		node := graph.Node(id)
+		if node == nil {
+			t.Errorf("expected node %s", id)
+			continue
+		}
+		if !reflect.DeepEqual(node.Requires, requires) {
+			t.Errorf("node %s: expected %v, got %v", id, requires, node.Requires)
+		}
+	}
+}
+
+func TestGraphCycle(t *testing.T) {
+	prog := Program{
+		Templates: map[string]Template{
+			"a": Template{
+				Name:     "a",
+				Prehooks: []string{"b"},
+			},
+			"b": Template{
+				Name:      "b",
+				Posthooks: []string{"a"},
+			},
+		},
+	}
+
+	_, err := NewGraph(prog)
+	cerr, ok := err.(CycleError)
+	if !ok {
+		t.Fatalf("expected CycleError, got %v", err)
+	}
+
+	expected := []string{"template 'a'", "template 'b'", "template 'a'"}
+	if !reflect.DeepEqual(cerr.Cycle, expected) {
+		t.Errorf("expected %v, got %v", expected, cerr.Cycle)
+	}
+
+	// Running the template must not recurse endlessly
+	if _, err := prog.RunTemplate("a"); err == nil {
+		t.Error("expected RunTemplate to fail")
+	}
+}
+
+func TestGraphDot(t *testing.T) {
+	graph, err := NewGraph(chainProg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subgraph, err := graph.Subgraph("build/tsconfig.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := subgraph.WriteDot(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph poul {
+	"file:build/tsconfig.json" [label="build/tsconfig.json", shape=note];
+	"step:tsconfig.json -> build/tsconfig.json" [label="tsconfig.json -> build/tsconfig.json", shape=ellipse];
+	"file:tsconfig.json" [label="tsconfig.json", shape=note];
+	"file:build/tsconfig.json" -> "step:tsconfig.json -> build/tsconfig.json";
+	"step:tsconfig.json -> build/tsconfig.json" -> "file:tsconfig.json";
+}
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,124 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ShellAttribute follows a step's declaration to choose the interpreter
+// running its code, e.g. @shell bash.
+const ShellAttribute = "@shell"
+
+// Shebang starts the first line of a step's code choosing the
+// interpreter, e.g. #!/usr/bin/env python3.
+const Shebang = "#!"
+
+// Shells which, like /bin/sh for steps without an interpreter, are run
+// with -e when chosen by @shell, so a failing command fails the step.
+var errexitShells = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"dash": true,
+	"ksh":  true,
+	"zsh":  true,
+}
+
+// Interpreter returns the command line of the interpreter running the
+// step's code, taken from its Shell or from a shebang line. The code of
+// such steps is passed to the interpreter as a script file. Other steps,
+// for which nil is returned, are run by /bin/sh -e -c. Either way the
+// code's common indentation is removed first. An sh-compatible Shell,
+// e.g. @shell bash, is passed -e as well, while a shebang line is used
+// as written.
+func (step Step) Interpreter() []string {
+	if step.Shell != "" {
+		return errexit(strings.Fields(step.Shell))
+	}
+
+	code := strings.TrimSpace(step.Code)
+	if !strings.HasPrefix(code, Shebang) {
+		return nil
+	}
+	line := strings.SplitN(code, "\n", 2)[0]
+	return strings.Fields(line[len(Shebang):])
+}
+
+// Create the command running the step's code. The returned function
+// removes the script file, if one has been written.
+func (step Step) command() (*exec.Cmd, func(), error) {
+	code := dedent(step.Code)
+	interpreter := step.Interpreter()
+	if len(interpreter) == 0 {
+		return exec.Command("/bin/sh", "-e", "-c", code), func() {}, nil
+	}
+
+	file, err := ioutil.TempFile("", "poul")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		os.Remove(file.Name())
+	}
+
+	_, err = file.WriteString(code)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return nil, nil, err
+	}
+
+	args := append(interpreter[1:], file.Name())
+	return exec.Command(interpreter[0], args...), remove, nil
+}
+
+// Insert -e after an sh-compatible shell, which may be invoked through
+// env, unless it is already given.
+func errexit(interpreter []string) []string {
+	index := 0
+	if filepath.Base(interpreter[0]) == "env" && len(interpreter) > 1 {
+		index = 1
+	}
+	if !errexitShells[filepath.Base(interpreter[index])] {
+		return interpreter
+	}
+	for _, arg := range interpreter[index+1:] {
+		if arg == "-e" {
+			return interpreter
+		}
+	}
+
+	result := append([]string{}, interpreter[:index+1]...)
+	result = append(result, "-e")
+	return append(result, interpreter[index+1:]...)
+}
+
+// Remove the indentation common to all non-blank lines.
+func dedent(code string) string {
+	lines := strings.Split(code, "\n")
+
+	prefix := ""
+	found := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			prefix, found = indent, true
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	for index, line := range lines {
+		lines[index] = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,98 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInterpreter(t *testing.T) {
+	step := Step{Code: "\n\t#!/usr/bin/env python3 -u\n\tprint(1)\n"}
+	if interpreter := step.Interpreter(); !reflect.DeepEqual(interpreter, []string{"/usr/bin/env", "python3", "-u"}) {
+		t.Errorf("unexpected interpreter: %v", interpreter)
+	}
+
+	step.Shell = "node"
+	if interpreter := step.Interpreter(); !reflect.DeepEqual(interpreter, []string{"node"}) {
+		t.Errorf("unexpected interpreter: %v", interpreter)
+	}
+
+	step.Shell = "/usr/bin/env bash"
+	if interpreter := step.Interpreter(); !reflect.DeepEqual(interpreter, []string{"/usr/bin/env", "bash", "-e"}) {
+		t.Errorf("unexpected interpreter: %v", interpreter)
+	}
+
+	step.Shell = "sh -e -x"
+	if interpreter := step.Interpreter(); !reflect.DeepEqual(interpreter, []string{"sh", "-e", "-x"}) {
+		t.Errorf("unexpected interpreter: %v", interpreter)
+	}
+
+	if interpreter := (Step{Code: "echo hello\n"}).Interpreter(); interpreter != nil {
+		t.Errorf("expected no interpreter, got %v", interpreter)
+	}
+}
+
+func TestRunInterpreter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	dest := filepath.Join(dir, "dest")
+	if err := ioutil.WriteFile(source, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The script is dedented, so the heredoc ends
+	step := Step{
+		Code: "\t#!/bin/sh -e\n\tcat - \"$POUL_SRC\" > \"$POUL_DEST\" <<EOF\n\t  indented\n\tEOF\n",
+	}
+	if code, err := (Program{}).Run(step, source, dest, nil); code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+
+	content, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "  indented\nhello\n" {
+		t.Errorf("unexpected content: %q", content)
+	}
+
+	// Steps without an interpreter are dedented as well
+	step = Step{
+		Code: "\tcat > \"$POUL_DEST\" <<EOF\n\thello\n\tEOF\n\techo after >> \"$POUL_DEST\"\n",
+	}
+	if code, err := (Program{Force: true}).Run(step, source, dest, nil); code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+
+	content, err = ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello\nafter\n" {
+		t.Errorf("unexpected content: %q", content)
+	}
+
+	// Like steps without an interpreter, sh stops at a failing command
+	step = Step{
+		Shell: "sh",
+		Code:  "false\ntrue\n",
+	}
+	if code, err := (Program{Force: true}).Run(step, source, dest, nil); code != 1 || err != nil {
+		t.Errorf("expected failing command to fail the step, got %d (%v)", code, err)
+	}
+
+	step = Step{
+		Shell: filepath.Join(dir, "missing"),
+		Code:  "echo hello\n",
+	}
+	if code, err := (Program{Force: true}).Run(step, source, dest, nil); code == 0 || err == nil {
+		t.Errorf("expected missing interpreter to fail, got %d (%v)", code, err)
+	}
+}
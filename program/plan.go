@@ -0,0 +1,264 @@
+package program
+
+import (
+	"path"
+	"sort"
+
+	"github.com/Acconut/poul/glob"
+)
+
+// A plan collects the step matches required to produce a set of
+// destinations, ordered so that every match comes after the matches
+// building its source and dependencies.
+type plan struct {
+	prog    Program
+	matches []StepMatch
+	// Indexes of the matches each match requires
+	after    [][]int
+	planned  map[string]int
+	visiting []string
+}
+
+func newPlan(prog Program) *plan {
+	return &plan{
+		prog:     prog,
+		matches:  make([]StepMatch, 0),
+		after:    make([][]int, 0),
+		planned:  make(map[string]int),
+		visiting: make([]string, 0),
+	}
+}
+
+// Add the step building dest and all steps it transitively requires.
+// It reports whether a step building dest has been found.
+func (p *plan) addDestination(dest string) (bool, error) {
+	match, ok, err := p.prog.builder(dest)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	_, err = p.addMatch(match)
+	return true, err
+}
+
+// Add every step compiling source. It reports whether one has been found.
+func (p *plan) addSource(source string) (bool, error) {
+	hadMatch := false
+	for _, step := range p.prog.Steps {
+		args, matches, err := step.Compiles(source)
+		if err != nil {
+			return false, err
+		}
+
+		if matches {
+			hadMatch = true
+			_, err := p.addMatch(step.Match(source, args))
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return hadMatch, nil
+}
+
+// Add a match after the steps building its inputs and return its index.
+// Inputs which no step builds are expected to exist already.
+func (p *plan) addMatch(match StepMatch) (int, error) {
+	key := matchKey(match)
+	if index, ok := p.planned[key]; ok {
+		return index, nil
+	}
+	for index, visiting := range p.visiting {
+		if visiting == key {
+			return -1, newCycleError(StepNode, append(p.visiting[index:], key))
+		}
+	}
+	p.visiting = append(p.visiting, key)
+
+	inputs, err := match.Step.Inputs(match.Source, match.Args)
+	if err != nil {
+		return -1, err
+	}
+
+	after := make([]int, 0)
+	for _, input := range inputs {
+		prerequisite, ok, err := p.prog.builder(input)
+		if err != nil {
+			return -1, err
+		}
+		if !ok {
+			continue
+		}
+
+		index, err := p.addMatch(prerequisite)
+		if err != nil {
+			return -1, err
+		}
+		after = append(after, index)
+	}
+
+	p.visiting = p.visiting[:len(p.visiting)-1]
+	p.planned[key] = len(p.matches)
+	p.matches = append(p.matches, match)
+	p.after = append(p.after, after)
+	return len(p.matches) - 1, nil
+}
+
+type planResult struct {
+	index int
+	code  int
+	err   error
+}
+
+// Run the planned matches, up to prog.Jobs at the same time. A match is
+// only started once all matches it requires have finished successfully.
+// After the first failure no further matches are started.
+func (prog Program) runPlan(p *plan) (int, error) {
+	if prog.DryRun != nil {
+		return prog.dryRunPlan(p)
+	}
+
+	if prog.Jobs <= 1 {
+		for _, match := range p.matches {
+			code, err := prog.Run(match.Step, match.Source, match.Destination, match.Args)
+			if code != 0 {
+				return code, err
+			}
+		}
+		return 0, nil
+	}
+
+	// Count the unfinished prerequisites of every match
+	pending := make([]int, len(p.matches))
+	dependents := make([][]int, len(p.matches))
+	ready := make([]int, 0)
+	for index, after := range p.after {
+		pending[index] = len(after)
+		for _, prerequisite := range after {
+			dependents[prerequisite] = append(dependents[prerequisite], index)
+		}
+		if len(after) == 0 {
+			ready = append(ready, index)
+		}
+	}
+
+	results := make(chan planResult)
+	running := 0
+	code, err := 0, error(nil)
+	for {
+		for code == 0 && running < prog.Jobs && len(ready) > 0 {
+			index := ready[0]
+			ready = ready[1:]
+			running++
+
+			go func(index int) {
+				match := p.matches[index]
+				code, err := prog.Run(match.Step, match.Source, match.Destination, match.Args)
+				results <- planResult{index, code, err}
+			}(index)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		if result.code != 0 {
+			if code == 0 {
+				code, err = result.code, result.err
+			}
+			continue
+		}
+
+		for _, dependent := range dependents[result.index] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return code, err
+}
+
+// Find the step building dest with the highest precedence.
+func (prog Program) builder(dest string) (StepMatch, bool, error) {
+	matches, _, err := prog.Builders(dest)
+	if err != nil || len(matches) == 0 {
+		return StepMatch{}, false, err
+	}
+	return matches[0], true, nil
+}
+
+// Builders returns the matches of all steps building dest, ordered by
+// precedence: steps whose destination pattern is more specific come
+// first, equally specific ones in the order of the Poulfile. It also
+// reports whether the first two are equally specific, which makes the
+// choice ambiguous.
+func (prog Program) Builders(dest string) ([]StepMatch, bool, error) {
+	dest = path.Clean(dest)
+	builders := make([]StepMatch, 0)
+	patterns := make([]*glob.Pattern, 0)
+	for _, step := range prog.Steps {
+		matched, args, matches, err := step.builds(dest)
+		if err != nil {
+			return nil, false, err
+		}
+		if !matches {
+			continue
+		}
+
+		pattern, err := glob.NewPattern(matched)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Matches always name the primary destination, so a step is
+		// planned only once whichever of its outputs is requested.
+		primary := dest
+		if matched != step.Destination {
+			primary = path.Clean(glob.Replace(step.Destination, args))
+		}
+
+		// The source of aggregating steps is expanded as pattern, in
+		// which the arguments must be matched literally
+		source := glob.Replace(step.Source, args)
+		if step.Aggregate {
+			source = glob.Replace(step.Source, escapeArgs(args))
+		}
+
+		builders = append(builders, StepMatch{
+			Step:        step,
+			Source:      source,
+			Destination: primary,
+			Args:        args,
+		})
+		patterns = append(patterns, pattern)
+	}
+
+	sort.Stable(byPrecedence{builders, patterns})
+
+	ambiguous := len(builders) > 1 && patterns[0].CompareSpecificity(*patterns[1]) == 0
+	return builders, ambiguous, nil
+}
+
+// Sorts matches by the specificity of their destination patterns.
+type byPrecedence struct {
+	matches  []StepMatch
+	patterns []*glob.Pattern
+}
+
+func (p byPrecedence) Len() int {
+	return len(p.matches)
+}
+
+func (p byPrecedence) Less(i, j int) bool {
+	return p.patterns[i].CompareSpecificity(*p.patterns[j]) < 0
+}
+
+func (p byPrecedence) Swap(i, j int) {
+	p.matches[i], p.matches[j] = p.matches[j], p.matches[i]
+	p.patterns[i], p.patterns[j] = p.patterns[j], p.patterns[i]
+}
@@ -0,0 +1,324 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var chainProg = Program{
+	Steps: []Step{
+		Step{
+			Source:      "build/$1.js",
+			Destination: "dist/$1.min.js",
+		},
+		Step{
+			Source:       "src/$1.ts",
+			Dependencies: []string{"build/tsconfig.json"},
+			Destination:  "build/$1.js",
+		},
+		Step{
+			Source:      "tsconfig.json",
+			Destination: "build/tsconfig.json",
+		},
+	},
+}
+
+func TestPlanChain(t *testing.T) {
+	p := newPlan(chainProg)
+	ok, err := p.addDestination("dist/foo.min.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected step to be found")
+	}
+
+	expected := []string{
+		"build/tsconfig.json",
+		"build/foo.js",
+		"dist/foo.min.js",
+	}
+	if len(p.matches) != len(expected) {
+		t.Fatalf("expected %d matches, got %d", len(expected), len(p.matches))
+	}
+	for index, dest := range expected {
+		if p.matches[index].Destination != dest {
+			t.Errorf("expected %s at position %d, got %s", dest, index, p.matches[index].Destination)
+		}
+	}
+
+	// Sources which are yet to be built aren't patterns
+	p = newPlan(chainProg)
+	if _, err := p.addDestination("dist/a[1].min.js"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"build/tsconfig.json",
+		"build/a[1].js",
+		"dist/a[1].min.js",
+	}
+	if len(p.matches) != len(expected) {
+		t.Fatalf("expected %d matches, got %d", len(expected), len(p.matches))
+	}
+	for index, dest := range expected {
+		if p.matches[index].Destination != dest {
+			t.Errorf("expected %s at position %d, got %s", dest, index, p.matches[index].Destination)
+		}
+	}
+}
+
+func TestPlanCycle(t *testing.T) {
+	prog := Program{
+		Steps: []Step{
+			Step{
+				Source:      "b",
+				Destination: "a",
+			},
+			Step{
+				Source:      "a",
+				Destination: "b",
+			},
+		},
+	}
+
+	_, err := newPlan(prog).addDestination("a")
+	if _, ok := err.(CycleError); !ok {
+		t.Errorf("expected CycleError, got %v", err)
+	}
+}
+
+func TestRunPlanParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prog := Program{
+		Jobs: 4,
+		Steps: []Step{
+			Step{
+				Source:      dir + "/$1.mid",
+				Destination: dir + "/$1.out",
+				Code:        `test -f "$POUL_SRC" && touch "$POUL_DEST"`,
+			},
+			Step{
+				Source:      dir + "/$1.in",
+				Destination: dir + "/$1.mid",
+				Code:        `sleep 0.1 && touch "$POUL_DEST"`,
+			},
+		},
+	}
+
+	dests := []string{
+		dir + "/a.out",
+		dir + "/b.out",
+		dir + "/c.out",
+		dir + "/d.out",
+	}
+	code, err := prog.BuildMulti(dests)
+	if code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+
+	for _, dest := range dests {
+		if _, err := os.Stat(dest); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	prog := Program{
+		Steps: []Step{
+			Step{
+				Source:      "src/**",
+				Destination: "dist/**",
+			},
+			Step{
+				Source:      "src/$1.md",
+				Destination: "dist/$1.html",
+			},
+			Step{
+				Source:      "src/index.jade",
+				Destination: "dist/index.html",
+			},
+			Step{
+				Source:      "pages/$1.md",
+				Destination: "dist/$1.html",
+			},
+		},
+	}
+
+	builders, ambiguous, err := prog.Builders("dist/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ambiguous {
+		t.Error("expected literal destination to be unambiguous")
+	}
+
+	expected := []string{"src/index.jade", "src/index.md", "pages/index.md", "src/**"}
+	if len(builders) != len(expected) {
+		t.Fatalf("expected %d builders, got %d", len(expected), len(builders))
+	}
+	for index, source := range expected {
+		if builders[index].Source != source {
+			t.Errorf("expected %s at position %d, got %s", source, index, builders[index].Source)
+		}
+	}
+
+	_, ambiguous, err = prog.Builders("dist/about.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ambiguous {
+		t.Error("expected equally specific destinations to be ambiguous")
+	}
+}
+
+func TestRunPlanOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/app.ts", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prog := Program{
+		Steps: []Step{
+			Step{
+				Source:      dir + "/$1.ts",
+				Destination: dir + "/$1.js",
+				Outputs:     []string{dir + "/$1.js.map"},
+				Code:        `touch $POUL_DESTS && echo run >> "` + dir + `/runs"`,
+			},
+		},
+	}
+
+	code, err := prog.BuildMulti([]string{dir + "/app.js.map", dir + "/app.js"})
+	if code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+
+	runs, err := ioutil.ReadFile(dir + "/runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runs) != "run\n" {
+		t.Errorf("expected step to run once, got %q", runs)
+	}
+	if _, err := os.Stat(dir + "/app.js.map"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunPlanAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.less", "b.less", "vars.inc"} {
+		if err := ioutil.WriteFile(dir+"/"+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prog := Program{
+		Force: true,
+		Steps: []Step{
+			Step{
+				Source:       dir + "/*.less",
+				Dependencies: []string{dir + "/*.inc"},
+				Destination:  dir + "/style.css",
+				Code:         `echo $POUL_SRCS >> "` + dir + `/runs"`,
+				Aggregate:    true,
+			},
+		},
+	}
+
+	if code, err := prog.CompileByDependency(dir + "/vars.inc"); code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+	if code, err := prog.CompileMulti([]string{dir + "/a.less", dir + "/b.less"}); code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%v)", code, err)
+	}
+
+	runs, err := ioutil.ReadFile(dir + "/runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := dir + "/a.less " + dir + "/b.less\n"
+	if string(runs) != run+run {
+		t.Errorf("expected step to run once per call with all sources, got %q", runs)
+	}
+}
+
+func TestRunPlanPhony(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/app.ts", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prog := Program{
+		Steps: []Step{
+			Step{
+				Destination:  "deploy",
+				Dependencies: []string{dir + "/app.js"},
+				Code:         `echo $POUL_DEST >> "` + dir + `/runs"`,
+				Phony:        true,
+			},
+			Step{
+				Source:      dir + "/$1.ts",
+				Destination: dir + "/$1.js",
+				Code:        `touch "$POUL_DEST"`,
+			},
+		},
+		Templates: map[string]Template{
+			"release": Template{
+				Name:         "release",
+				Destinations: []string{"deploy"},
+			},
+		},
+	}
+
+	// Phony steps run even though their destination never exists
+	for i := 0; i < 2; i++ {
+		if code, err := prog.RunTemplate("release"); code != 0 || err != nil {
+			t.Fatalf("unexpected result: %d (%v)", code, err)
+		}
+	}
+
+	runs, err := ioutil.ReadFile(dir + "/runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runs) != "deploy\ndeploy\n" {
+		t.Errorf("expected phony step to run every time, got %q", runs)
+	}
+	if _, err := os.Stat(dir + "/app.js"); err != nil {
+		t.Error(err)
+	}
+
+	graph, err := NewGraph(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := graph.Node(PhonyNode + ":deploy"); node == nil {
+		t.Error("expected phony node for deploy")
+	}
+	if generated := graph.Generated(); len(generated) != 1 || generated[0] != dir+"/app.js" {
+		t.Errorf("expected only %s/app.js to be generated, got %v", dir, generated)
+	}
+}
@@ -2,12 +2,14 @@ package program
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
-
-	"github.com/Acconut/poul/glob"
 )
 
 var ErrStepNotFound = errors.New("program: step not found")
@@ -17,40 +19,86 @@ var ErrNoMatch = errors.New("program: no matching step found")
 type Program struct {
 	Steps     []Step
 	Templates map[string]Template
+
+	// Variables defined in the Poulfile. They are exported to the code of
+	// every step.
+	Variables map[string]string `json:",omitempty"`
+
+	// Force runs every step, even if its destination is up to date.
+	Force bool `json:"-"`
+
+	// State, if set, is used to decide whether a destination is up to
+	// date by comparing hashes instead of modification times.
+	State *State `json:"-"`
+
+	// Jobs is the maximum number of steps running at the same time.
+	// Values below two run all steps one after another.
+	Jobs int `json:"-"`
+
+	// DryRun, if set, receives a description of the steps which would
+	// run, including their environment and code, instead of running them.
+	DryRun io.Writer `json:"-"`
 }
 
 type Template struct {
-	Name         string
-	Prehooks     []string
-	Posthooks    []string
+	Name      string
+	Prehooks  []string
+	Posthooks []string
+	// Destinations may be patterns which are expanded at run time, see
+	// TemplateDestinations.
 	Destinations []string
 }
 
 func (prog Program) RunTemplate(name string) (int, error) {
+	return prog.runTemplate(name, nil)
+}
+
+// Run a template whose hooks are executed as part of the templates
+// in parents, which is used to detect templates requiring themselves.
+func (prog Program) runTemplate(name string, parents []string) (int, error) {
 	tpl, ok := prog.Templates[name]
 	if !ok {
 		return -1, ErrTemplateNotFound
 	}
 
+	for index, parent := range parents {
+		if parent == name {
+			return -1, newCycleError(TemplateNode, append(parents[index:], name))
+		}
+	}
+	parents = append(parents, name)
+
 	// Run prehooks
 	for _, hook := range tpl.Prehooks {
-		code, err := prog.RunTemplate(hook)
+		code, err := prog.runTemplate(hook, parents)
 		if err != nil || code != 0 {
 			return code, err
 		}
 	}
 
 	// Run steps for destinations
-	for _, dest := range tpl.Destinations {
-		code, err := prog.Build(dest)
-		if err != nil || code != 0 {
-			return code, err
+	dests, err := prog.TemplateDestinations(tpl)
+	if err != nil {
+		return -1, err
+	}
+	p := newPlan(prog)
+	for _, dest := range dests {
+		ok, err := p.addDestination(dest)
+		if err != nil {
+			return -1, err
+		}
+		if !ok {
+			return -1, ErrNoMatch
 		}
 	}
+	code, err := prog.runPlan(p)
+	if err != nil || code != 0 {
+		return code, err
+	}
 
 	// Run posthooks
 	for _, hook := range tpl.Posthooks {
-		code, err := prog.RunTemplate(hook)
+		code, err := prog.runTemplate(hook, parents)
 		if err != nil || code != 0 {
 			return code, err
 		}
@@ -59,58 +107,39 @@ func (prog Program) RunTemplate(name string) (int, error) {
 	return 0, nil
 }
 
-func (prog Program) Build(dest string) (int, error) {
-	for _, step := range prog.Steps {
-		args, matches, err := step.Builds(dest)
-		if err != nil {
-			return -1, err
-		}
-
-		if matches {
-			source := glob.Replace(step.Source, args)
-			return prog.Run(step, source, dest, args)
-		}
-	}
+// IsPhony reports whether name is built by a phony step.
+func (prog Program) IsPhony(name string) (bool, error) {
+	match, ok, err := prog.builder(name)
+	return ok && match.Step.Phony, err
+}
 
-	return -1, ErrNoMatch
+// Build runs the step building dest after the steps building its
+// source and dependencies, if those are produced by other steps.
+func (prog Program) Build(dest string) (int, error) {
+	return prog.BuildMulti([]string{dest})
 }
 
 func (prog Program) BuildMulti(dests []string) (int, error) {
+	p := newPlan(prog)
 	for _, dest := range dests {
-		code, err := prog.Build(dest)
-		if code != 0 {
-			return code, err
-		}
-	}
-	return 0, nil
-}
-
-func (prog Program) Compile(source string) (int, error) {
-	hadMatch := false
-	for _, step := range prog.Steps {
-		args, matches, err := step.Compiles(source)
+		ok, err := p.addDestination(dest)
 		if err != nil {
 			return -1, err
 		}
-
-		if matches {
-			hadMatch = true
-			dest := glob.Replace(step.Destination, args)
-			code, err := prog.Run(step, source, dest, args)
-			if code != 0 || err != nil {
-				return code, err
-			}
+		if !ok {
+			return -1, ErrNoMatch
 		}
 	}
 
-	if hadMatch {
-		return 0, nil
-	}
+	return prog.runPlan(p)
+}
 
-	return -1, ErrNoMatch
+func (prog Program) Compile(source string) (int, error) {
+	return prog.CompileMulti([]string{source})
 }
 
 func (prog Program) CompileByDependency(dep string) (int, error) {
+	p := newPlan(prog)
 	hadMatch := false
 	for _, step := range prog.Steps {
 		depends, err := step.DependsOn(dep)
@@ -124,68 +153,205 @@ func (prog Program) CompileByDependency(dep string) (int, error) {
 			if err != nil {
 				return -1, err
 			}
-			code, err := prog.runMatches(matches)
-			if code != 0 {
-				return code, err
+			for _, match := range matches {
+				// Only compile the sources whose own dependencies,
+				// with their arguments substituted, include dep
+				depends, err := step.dependsOn(dep, match.Args)
+				if err != nil {
+					return -1, err
+				}
+				if !depends {
+					continue
+				}
+
+				if _, err := p.addMatch(match); err != nil {
+					return -1, err
+				}
 			}
 		}
 	}
 
 	if hadMatch {
-		return 0, nil
+		return prog.runPlan(p)
 	}
 
 	return -1, ErrNoMatch
 }
 
-func (prog Program) runMatches(matches []StepMatch) (int, error) {
-	for _, match := range matches {
-		code, err := prog.Run(match.Step, match.Source, match.Destination, match.Args)
-		if code != 0 {
-			return code, err
-		}
-	}
-	return 0, nil
-}
-
 func (prog Program) CompileMulti(sources []string) (int, error) {
+	p := newPlan(prog)
 	for _, source := range sources {
-		code, err := prog.Compile(source)
-		if code != 0 {
-			return code, err
+		ok, err := p.addSource(source)
+		if err != nil {
+			return -1, err
+		}
+		if !ok {
+			return -1, ErrNoMatch
 		}
 	}
-	return 0, nil
+
+	return prog.runPlan(p)
 }
 
-func (prog Program) Run(step Step, source, dest string, args map[int]string) (int, error) {
-	cmd := exec.Command("/bin/sh", "-e", "-c", step.Code)
+func (prog Program) Run(step Step, source, dest string, args map[string]string) (int, error) {
+	// Hash the inputs before running the step so the recorded
+	// state reflects what the destination was built from
+	hash := ""
+	if prog.State != nil && !step.Phony {
+		var err error
+		hash, err = prog.Hash(step, source, dest, args)
+		if err != nil {
+			return -1, err
+		}
+	}
 
-	// Setup environment variables
-	env := os.Environ()
-	env = append(env, "POUL_SRC="+source)
-	env = append(env, "POUL_DEST="+dest)
+	// Skip steps whose destination is up to date
+	if !prog.Force {
+		stale, _, err := prog.stale(step, source, dest, args, hash)
+		if err != nil {
+			return -1, err
+		}
+		if !stale {
+			return 0, nil
+		}
+	}
 
-	// Setup arguments
-	for index, value := range args {
-		env = append(env, "POUL_ARG_"+strconv.Itoa(index)+"="+value)
+	env, err := prog.Environment(StepMatch{step, source, dest, args})
+	if err != nil {
+		return -1, err
 	}
 
-	cmd.Env = env
+	cmd, cleanup, err := step.command()
+	if err != nil {
+		return -1, err
+	}
+	defer cleanup()
+	cmd.Env = append(os.Environ(), env...)
 
 	// Pipe output to stdout/stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	code, ok := getExitCode(err)
 	if ok {
+		if code == 0 && prog.State != nil && !step.Phony {
+			prog.State.Record(dest, hash)
+		}
 		return code, nil
 	}
 
 	return -1, err
 }
 
+// Stale reports whether the step has to run in order to build dest from
+// source. Phony steps always run. Otherwise, if the program has a State,
+// the hash of the step's inputs is compared to the recorded one, else
+// modification times are used.
+func (prog Program) Stale(step Step, source, dest string, args map[string]string) (bool, string, error) {
+	hash := ""
+	if prog.State != nil && !step.Phony {
+		var err error
+		hash, err = prog.Hash(step, source, dest, args)
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	return prog.stale(step, source, dest, args, hash)
+}
+
+func (prog Program) stale(step Step, source, dest string, args map[string]string, hash string) (bool, string, error) {
+	if step.Phony {
+		return true, fmt.Sprintf("'%s' is phony", dest), nil
+	}
+	if prog.State != nil {
+		return prog.State.Stale(step.Destinations(dest, args), hash)
+	}
+	return step.Stale(source, dest, args)
+}
+
+// Environment returns the variables exported to a step's code. The
+// source files are exported as POUL_SRCS. POUL_DEST is the first of
+// dests, each of them is exported as POUL_DEST_<index> and all together
+// as POUL_DESTS. Both lists are separated by newlines, so names
+// containing spaces survive, e.g. while read -r src. Every argument is
+// exported as POUL_ARG_<name>, e.g. POUL_ARG_1 or POUL_ARG_lang.
+func Environment(source string, sources, dests []string, args map[string]string) []string {
+	env := []string{
+		"POUL_SRC=" + source,
+		"POUL_SRCS=" + strings.Join(sources, "\n"),
+		"POUL_DEST=" + dests[0],
+	}
+
+	for index, dest := range dests {
+		env = append(env, "POUL_DEST_"+strconv.Itoa(index)+"="+dest)
+	}
+	env = append(env, "POUL_DESTS="+strings.Join(dests, "\n"))
+
+	for _, name := range sortedNames(args) {
+		env = append(env, "POUL_ARG_"+name+"="+args[name])
+	}
+
+	return env
+}
+
+// Environment returns the variables exported to the match's code.
+func (match StepMatch) Environment() ([]string, error) {
+	sources, err := match.Step.Sources(match.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	dests := match.Step.Destinations(match.Destination, match.Args)
+	return Environment(match.Source, sources, dests, match.Args), nil
+}
+
+// Environment returns the variables exported to the match's code, i.e.
+// the program's variables followed by the match's environment.
+func (prog Program) Environment(match StepMatch) ([]string, error) {
+	env, err := match.Environment()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(prog.Variables))
+	for name := range prog.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	variables := make([]string, 0, len(names)+len(env))
+	for _, name := range names {
+		variables = append(variables, name+"="+prog.Variables[name])
+	}
+	return append(variables, env...), nil
+}
+
+// Sort the names of arguments to get a stable environment. Numeric
+// names come first in numeric order, followed by all others.
+func sortedNames(args map[string]string) []string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, aErr := strconv.Atoi(names[i])
+		b, bErr := strconv.Atoi(names[j])
+		switch {
+		case aErr == nil && bErr == nil:
+			return a < b
+		case aErr == nil || bErr == nil:
+			return aErr == nil
+		default:
+			return names[i] < names[j]
+		}
+	})
+
+	return names
+}
+
 // If possible get the exit code from an error
 func getExitCode(err error) (int, bool) {
 	if exiterr, ok := err.(*exec.ExitError); ok {
@@ -200,5 +366,10 @@ func getExitCode(err error) (int, bool) {
 		}
 	}
 
+	// The program could not be started, e.g. the interpreter is missing
+	if err != nil {
+		return -1, false
+	}
+
 	return 0, true
 }
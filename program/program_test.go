@@ -1,5 +1,10 @@
 package program
 
+import (
+	"fmt"
+	"os"
+)
+
 var prog = Program{
 	Templates: map[string]Template{
 		"echo": Template{
@@ -38,6 +43,114 @@ func ExampleProgram_Build() {
 	// POUL_ARG_1: bar
 }
 
+func ExampleProgram_Build_dryRun() {
+	dryProg := prog
+	dryProg.DryRun = os.Stdout
+	code, err := dryProg.Build("test/out/bar")
+	if err != nil {
+		panic(err)
+	}
+	if code != 0 {
+		panic("not null")
+	}
+	// Output:
+	// # test/bar.txt -> test/out/bar (destination 'test/out/bar' does not exist)
+	// POUL_SRC=test/bar.txt
+	// POUL_SRCS=test/bar.txt
+	// POUL_DEST=test/out/bar
+	// POUL_DEST_0=test/out/bar
+	// POUL_DESTS=test/out/bar
+	// POUL_ARG_1=bar
+	// echo "POUL_SRC: ${POUL_SRC}"
+	// echo "POUL_DEST: ${POUL_DEST}"
+	// echo "POUL_ARG_1: ${POUL_ARG_1}"
+}
+
+func ExampleProgram_Build_dryRunIndented() {
+	dryProg := Program{
+		Steps: []Step{
+			Step{
+				Source:      "test/$1.txt",
+				Destination: "test/out/$1.py",
+				Shell:       "python3",
+				Code:        "\n\tfor line in open('test/bar.txt'):\n\t\tprint(line)\n",
+			},
+		},
+		DryRun: os.Stdout,
+	}
+	code, err := dryProg.Build("test/out/bar.py")
+	if err != nil {
+		panic(err)
+	}
+	if code != 0 {
+		panic("not null")
+	}
+	// Output:
+	// # test/bar.txt -> test/out/bar.py (destination 'test/out/bar.py' does not exist)
+	// POUL_SRC=test/bar.txt
+	// POUL_SRCS=test/bar.txt
+	// POUL_DEST=test/out/bar.py
+	// POUL_DEST_0=test/out/bar.py
+	// POUL_DESTS=test/out/bar.py
+	// POUL_ARG_1=bar
+	// # @shell python3
+	// for line in open('test/bar.txt'):
+	// 	print(line)
+}
+
+func ExampleEnvironment() {
+	sources := []string{"src/de/index.md"}
+	dests := []string{"dist/de/index.html", "dist/de/index.json"}
+	env := Environment("src/de/index.md", sources, dests, map[string]string{
+		"page": "index",
+		"lang": "de",
+		"10":   "ten",
+		"2":    "two",
+	})
+	for _, value := range env {
+		fmt.Println(value)
+	}
+	// Output:
+	// POUL_SRC=src/de/index.md
+	// POUL_SRCS=src/de/index.md
+	// POUL_DEST=dist/de/index.html
+	// POUL_DEST_0=dist/de/index.html
+	// POUL_DEST_1=dist/de/index.json
+	// POUL_DESTS=dist/de/index.html
+	// dist/de/index.json
+	// POUL_ARG_2=two
+	// POUL_ARG_10=ten
+	// POUL_ARG_lang=de
+	// POUL_ARG_page=index
+}
+
+func ExampleProgram_Environment() {
+	prog := Program{
+		Variables: map[string]string{
+			"OUT":    "dist",
+			"MINIFY": "--minify",
+		},
+	}
+	env, err := prog.Environment(StepMatch{
+		Step:        Step{Destination: "dist/app.js"},
+		Destination: "dist/app.js",
+	})
+	if err != nil {
+		panic(err)
+	}
+	for _, value := range env {
+		fmt.Println(value)
+	}
+	// Output:
+	// MINIFY=--minify
+	// OUT=dist
+	// POUL_SRC=
+	// POUL_SRCS=
+	// POUL_DEST=dist/app.js
+	// POUL_DEST_0=dist/app.js
+	// POUL_DESTS=dist/app.js
+}
+
 func ExampleProgram_Compile() {
 	code, err := prog.Compile("test/foo.txt")
 	if err != nil {
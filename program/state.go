@@ -0,0 +1,143 @@
+package program
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// State is a persistent store recording, for each destination, a hash
+// of the inputs it was last built from successfully. Unlike modification
+// times it is not fooled by switching branches or restoring files.
+type State struct {
+	path   string
+	hashes map[string]string
+	mutex  sync.Mutex
+}
+
+// LoadState reads the state stored at path. A missing file results in
+// an empty state which will be created on the first save.
+func LoadState(path string) (*State, error) {
+	state := &State{
+		path:   path,
+		hashes: make(map[string]string),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &state.hashes); err != nil {
+		return nil, fmt.Errorf("program: invalid state file '%s': %s", path, err)
+	}
+
+	return state, nil
+}
+
+// Save writes the state back to the file it was loaded from.
+func (state *State) Save() error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	b, err := json.MarshalIndent(state.hashes, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(state.path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(state.path, b, 0644)
+}
+
+// Stale reports whether dests have to be rebuilt because one of them is
+// missing or the hash of their inputs differs from the recorded one. The
+// hash is recorded for the first destination.
+func (state *State) Stale(dests []string, hash string) (bool, string, error) {
+	for _, dest := range dests {
+		stale, reason, err := destinationStale(dest)
+		if stale || err != nil {
+			return stale, reason, err
+		}
+	}
+
+	dest := dests[0]
+	state.mutex.Lock()
+	recorded, ok := state.hashes[dest]
+	state.mutex.Unlock()
+
+	if !ok {
+		return true, fmt.Sprintf("no recorded state for destination '%s'", dest), nil
+	}
+	if recorded != hash {
+		return true, fmt.Sprintf("inputs of destination '%s' have changed", dest), nil
+	}
+	return false, fmt.Sprintf("destination '%s' is up to date", dest), nil
+}
+
+// Record stores the hash of the inputs dest has been built from.
+func (state *State) Record(dest, hash string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.hashes[dest] = hash
+}
+
+// Hash calculates a hash over everything influencing the result of
+// compiling source into dest: the step's code, the environment including
+// the program's variables and the content of the source and dependency
+// files.
+func (prog Program) Hash(step Step, source, dest string, args map[string]string) (string, error) {
+	inputs, err := step.Inputs(source, args)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := prog.Environment(StepMatch{step, source, dest, args})
+	if err != nil {
+		return "", err
+	}
+
+	// The code is hashed as it runs
+	code := dedent(step.Code)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "code %d\n%s\n", len(code), code)
+	if step.Shell != "" {
+		fmt.Fprintf(hash, "shell %s\n", step.Shell)
+	}
+	for _, value := range env {
+		fmt.Fprintf(hash, "env %s\n", value)
+	}
+
+	for _, input := range inputs {
+		file, err := os.Open(input)
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(hash, "missing %s\n", input)
+				continue
+			}
+			return "", err
+		}
+
+		content := sha256.New()
+		_, err = io.Copy(content, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "file %s %x\n", input, content.Sum(nil))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
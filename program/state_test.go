@@ -0,0 +1,69 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	dest := filepath.Join(dir, "dest")
+	statePath := filepath.Join(dir, ".poul", "state")
+
+	if err := ioutil.WriteFile(source, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog := Program{
+		State: state,
+	}
+	step := Step{
+		Code: `cat "$POUL_SRC" > "$POUL_DEST"`,
+	}
+
+	if code, err := prog.Run(step, source, dest, nil); code != 0 || err != nil {
+		t.Fatalf("unexpected result: %d (%s)", code, err)
+	}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload the state from disk
+	state, err = LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog.State = state
+
+	if stale, reason, err := prog.Stale(step, source, dest, nil); err != nil || stale {
+		t.Errorf("expected destination to be up to date: %s (%s)", reason, err)
+	}
+
+	// Changing the code invalidates the destination
+	step.Code += "\n"
+	if stale, _, err := prog.Stale(step, source, dest, nil); err != nil || !stale {
+		t.Errorf("expected changed code to make destination stale (%s)", err)
+	}
+	step.Code = step.Code[:len(step.Code)-1]
+
+	// Changing the source invalidates the destination
+	if err := ioutil.WriteFile(source, []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stale, _, err := prog.Stale(step, source, dest, nil); err != nil || !stale {
+		t.Errorf("expected changed source to make destination stale (%s)", err)
+	}
+}
@@ -1,49 +1,157 @@
 package program
 
 import (
+	"strings"
+
 	"github.com/Acconut/poul/glob"
 )
 
 type Step struct {
-	Source       string
-	Destination  string
+	Source string
+	// Patterns of files which are never used as source
+	Excludes    []string
+	Destination string
+	// Further destinations built by the same run of the step
+	Outputs      []string
 	Code         string
 	Dependencies []string
+	// Aggregating steps run once for all sources matching their pattern
+	// instead of once per source.
+	Aggregate bool
+	// Phony steps build no file. Their destination is a name which is
+	// never up to date. The source is optional.
+	Phony bool
+	// Shell is the command line of the interpreter running the code, see
+	// Interpreter.
+	Shell string `json:",omitempty"`
 }
 
+// Arrows separating the sources from the destinations of a step. The
+// aggregate arrow marks steps running once for all their sources.
+const (
+	Arrow          = "->"
+	AggregateArrow = "=>"
+)
+
+// Phony starts the declaration of a phony step.
+const Phony = "phony"
+
+// Exclusion marks patterns, in the source position or the dependencies,
+// whose matching files are ignored.
+const Exclusion = "!"
+
 type StepMatch struct {
 	Step        Step
 	Source      string
 	Destination string
-	Args        map[int]string
+	Args        map[string]string
 }
 
-func (step Step) Builds(dest string) (map[int]string, bool, error) {
-	return glob.SimpleMatch(step.Destination, dest)
+// String returns the step's header as written in a Poulfile.
+func (step Step) String() string {
+	// Phony steps without source are declared by their name
+	named := step.Phony && step.Source == ""
+
+	header := step.Source
+	for _, exclude := range step.Excludes {
+		header += ", " + Exclusion + exclude
+	}
+	if named {
+		header = step.Destination
+	}
+	if len(step.Dependencies) > 0 {
+		header += " (" + strings.Join(step.Dependencies, ", ") + ")"
+	}
+
+	if !named {
+		arrow := Arrow
+		if step.Aggregate {
+			arrow = AggregateArrow
+		}
+		header += " " + arrow + " " + strings.Join(step.destinationPatterns(), ", ")
+	}
+	if step.Phony {
+		header = Phony + " " + header
+	}
+	if step.Shell != "" {
+		header += " " + ShellAttribute + " " + step.Shell
+	}
+	return header
 }
 
-func (step Step) Compiles(source string) (map[int]string, bool, error) {
-	return glob.SimpleMatch(step.Source, source)
+// Builds reports whether dest matches one of the step's destinations and
+// returns the captured arguments.
+func (step Step) Builds(dest string) (map[string]string, bool, error) {
+	_, args, matches, err := step.builds(dest)
+	return args, matches, err
 }
 
-func (step Step) DependsOn(dep string) (bool, error) {
-	for _, item := range step.Dependencies {
-		pattern, err := glob.NewPattern(item)
+// Find the destination pattern matching dest. The step does not build
+// dest if its source is excluded.
+func (step Step) builds(dest string) (string, map[string]string, bool, error) {
+	for _, pattern := range step.destinationPatterns() {
+		args, matches, err := glob.SimpleMatch(pattern, dest)
 		if err != nil {
-			return false, err
+			return "", nil, false, err
+		}
+		if !matches {
+			continue
 		}
 
-		_, matches := pattern.Match(dep)
-		if matches {
-			return true, nil
+		excluded, err := matchesAny(step.Excludes, glob.Replace(step.Source, args))
+		if err != nil || excluded {
+			return "", nil, false, err
 		}
+		return pattern, args, true, nil
 	}
+	return "", nil, false, nil
+}
 
-	return false, nil
+func (step Step) Compiles(source string) (map[string]string, bool, error) {
+	if step.Source == "" {
+		return nil, false, nil
+	}
+	excluded, err := matchesAny(step.Excludes, source)
+	if err != nil || excluded {
+		return nil, false, err
+	}
+	return glob.SimpleMatch(step.Source, source)
+}
+
+// Destinations returns all files built by a single run of the step,
+// starting with dest, the resolved primary destination.
+func (step Step) Destinations(dest string, args map[string]string) []string {
+	return append([]string{dest}, glob.ReplaceSlice(step.Outputs, args)...)
+}
+
+// The primary destination followed by the further outputs.
+func (step Step) destinationPatterns() []string {
+	return append([]string{step.Destination}, step.Outputs...)
+}
+
+// DependsOn reports whether dep matches one of the step's dependencies.
+// Arguments in the dependencies act as wildcards.
+func (step Step) DependsOn(dep string) (bool, error) {
+	return step.dependsOn(dep, nil)
+}
+
+// Check whether dep matches one of the dependencies after substituting
+// the arguments captured from a source.
+func (step Step) dependsOn(dep string, args map[string]string) (bool, error) {
+	includes, excludes := step.dependencyPatterns(args)
+
+	excluded, err := matchesAny(excludes, dep)
+	if err != nil || excluded {
+		return false, err
+	}
+	return matchesAny(includes, dep)
 }
 
 func (step Step) FindSources() ([]StepMatch, error) {
 	matches := make([]StepMatch, 0)
+	if step.Source == "" {
+		return matches, nil
+	}
 	pattern, err := glob.NewPattern(step.Source)
 	if err != nil {
 		return matches, err
@@ -53,12 +161,80 @@ func (step Step) FindSources() ([]StepMatch, error) {
 		return matches, err
 	}
 	for _, entry := range entries {
-		matches = append(matches, StepMatch{
-			Step:        step,
-			Source:      entry.Name,
-			Destination: glob.Replace(step.Destination, entry.Args),
-			Args:        entry.Args,
-		})
+		excluded, err := matchesAny(step.Excludes, entry.Name)
+		if err != nil {
+			return matches, err
+		}
+		if excluded {
+			continue
+		}
+
+		matches = append(matches, step.Match(entry.Name, entry.Args))
+
+		// A single match covers all sources of an aggregating step
+		if step.Aggregate {
+			break
+		}
 	}
 	return matches, nil
 }
+
+// Match returns the match compiling source, whose arguments have been
+// captured by the source pattern. The match of an aggregating step has
+// the source pattern itself as source and no arguments.
+func (step Step) Match(source string, args map[string]string) StepMatch {
+	if step.Aggregate {
+		source = step.Source
+		args = make(map[string]string)
+	}
+
+	return StepMatch{
+		Step:        step,
+		Source:      source,
+		Destination: glob.Replace(step.Destination, args),
+		Args:        args,
+	}
+}
+
+// Split the dependencies into included and excluded patterns after
+// substituting the arguments. Their values are escaped so they are
+// matched literally.
+func (step Step) dependencyPatterns(args map[string]string) ([]string, []string) {
+	includes := make([]string, 0, len(step.Dependencies))
+	excludes := make([]string, 0)
+	for _, dep := range glob.ReplaceSlice(step.Dependencies, escapeArgs(args)) {
+		if strings.HasPrefix(dep, Exclusion) {
+			excludes = append(excludes, dep[len(Exclusion):])
+		} else {
+			includes = append(includes, dep)
+		}
+	}
+	return includes, excludes
+}
+
+// Escape the arguments' values so they are matched literally once
+// substituted into a pattern.
+func escapeArgs(args map[string]string) map[string]string {
+	escaped := make(map[string]string, len(args))
+	for name, value := range args {
+		escaped[name] = glob.Escape(value)
+	}
+	return escaped
+}
+
+// Check whether file matches one of the patterns.
+func matchesAny(patterns []string, file string) (bool, error) {
+	for _, item := range patterns {
+		pattern, err := glob.NewPattern(item)
+		if err != nil {
+			return false, err
+		}
+
+		_, matches := pattern.Match(file)
+		if matches {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,64 @@
+package program
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStepExcludes(t *testing.T) {
+	step := Step{
+		Source:       "src/$1.js",
+		Excludes:     []string{"src/*.test.js"},
+		Destination:  "dist/$1.js",
+		Dependencies: []string{"lib/*.js", "!lib/*.test.js"},
+	}
+
+	if _, matches, _ := step.Compiles("src/app.js"); !matches {
+		t.Error("expected src/app.js to be compiled")
+	}
+	if _, matches, _ := step.Compiles("src/app.test.js"); matches {
+		t.Error("expected src/app.test.js to be excluded")
+	}
+
+	if _, matches, _ := step.Builds("dist/app.js"); !matches {
+		t.Error("expected dist/app.js to be built")
+	}
+	if _, matches, _ := step.Builds("dist/app.test.js"); matches {
+		t.Error("expected dist/app.test.js not to be built from an excluded source")
+	}
+
+	if depends, _ := step.DependsOn("lib/util.js"); !depends {
+		t.Error("expected lib/util.js to be a dependency")
+	}
+	if depends, _ := step.DependsOn("lib/util.test.js"); depends {
+		t.Error("expected lib/util.test.js to be excluded from the dependencies")
+	}
+}
+
+func TestStepArgumentDependencies(t *testing.T) {
+	step := Step{
+		Source:       "src/$1.html",
+		Destination:  "dist/$1.html",
+		Dependencies: []string{"src/$1.data.json", "src/layout.html"},
+	}
+	args := map[string]string{"1": "index"}
+
+	inputs, err := step.Inputs("src/index.html", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"src/index.html", "src/index.data.json", "src/layout.html"}
+	if !reflect.DeepEqual(inputs, expected) {
+		t.Errorf("expected %v, got %v", expected, inputs)
+	}
+
+	if depends, _ := step.dependsOn("src/index.data.json", args); !depends {
+		t.Error("expected src/index.data.json to be a dependency of index")
+	}
+	if depends, _ := step.dependsOn("src/about.data.json", args); depends {
+		t.Error("expected src/about.data.json not to be a dependency of index")
+	}
+	if depends, _ := step.DependsOn("src/about.data.json"); !depends {
+		t.Error("expected src/about.data.json to be a dependency of the step")
+	}
+}
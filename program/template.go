@@ -0,0 +1,94 @@
+package program
+
+import (
+	"strings"
+
+	"github.com/Acconut/poul/glob"
+)
+
+// For separates a destination pattern in a template from the source
+// pattern it is expanded for, e.g. dist/$1.html for src/$1.jade.
+const For = "for"
+
+// SplitFor splits a template's destination into the destination pattern
+// and the source pattern following For. It reports whether there is one.
+func SplitFor(entry string) (string, string, bool) {
+	parts := strings.SplitN(entry, " "+For+" ", 2)
+	if len(parts) != 2 {
+		return entry, "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// TemplateDestinations expands the destinations of tpl into the files to
+// build. A destination pattern followed by a source pattern, e.g.
+// dist/$1.html for src/$1.jade, yields one destination for every existing
+// source with its arguments substituted. Other patterns, e.g.
+// dist/*.html, yield the destinations of all current step matches they
+// match. Literal destinations are used as they are.
+func (prog Program) TemplateDestinations(tpl Template) ([]string, error) {
+	dests := make([]string, 0, len(tpl.Destinations))
+	seen := make(map[string]bool)
+	for _, entry := range tpl.Destinations {
+		expanded, err := prog.expandDestination(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dest := range expanded {
+			if !seen[dest] {
+				seen[dest] = true
+				dests = append(dests, dest)
+			}
+		}
+	}
+	return dests, nil
+}
+
+func (prog Program) expandDestination(entry string) ([]string, error) {
+	if entry == "" {
+		return nil, nil
+	}
+
+	if dest, source, ok := SplitFor(entry); ok {
+		pattern, err := glob.NewPattern(source)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := pattern.Glob()
+		if err != nil {
+			return nil, err
+		}
+
+		dests := make([]string, len(entries))
+		for index, entry := range entries {
+			dests[index] = glob.Replace(dest, entry.Args)
+		}
+		return dests, nil
+	}
+
+	pattern, err := glob.NewPattern(entry)
+	if err != nil {
+		return nil, err
+	}
+	if text, ok := pattern.Literal(); ok {
+		return []string{text}, nil
+	}
+
+	dests := make([]string, 0)
+	for _, step := range prog.Steps {
+		matches, err := step.FindSources()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			for _, dest := range step.Destinations(match.Destination, match.Args) {
+				if _, ok := pattern.Match(dest); ok {
+					dests = append(dests, dest)
+				}
+			}
+		}
+	}
+	return dests, nil
+}
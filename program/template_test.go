@@ -0,0 +1,60 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTemplateDestinations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"index.jade", "about.jade", "style.less"} {
+		if err := ioutil.WriteFile(dir+"/"+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prog := Program{
+		Steps: []Step{
+			Step{
+				Source:      dir + "/$1.jade",
+				Destination: dir + "/dist/$1.html",
+			},
+			Step{
+				Source:      dir + "/$1.less",
+				Destination: dir + "/dist/$1.css",
+				Outputs:     []string{dir + "/dist/$1.css.map"},
+			},
+		},
+	}
+
+	dests, err := prog.TemplateDestinations(Template{
+		Destinations: []string{
+			dir + "/dist/$1.html for " + dir + "/$1.jade",
+			dir + "/dist/style.*",
+			dir + "/dist/about.html",
+			"deploy",
+			"",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		dir + "/dist/about.html",
+		dir + "/dist/index.html",
+		dir + "/dist/style.css",
+		dir + "/dist/style.css.map",
+		"deploy",
+	}
+	if !reflect.DeepEqual(dests, expected) {
+		t.Errorf("expected %v, got %v", expected, dests)
+	}
+}